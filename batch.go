@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --------------------------- Batch jobs
+
+// Exit codes of the batch mode
+const (
+	batchExitOK      = 0
+	batchExitFailed  = 1
+	batchExitInvalid = 2
+)
+
+// errBatchArgument is returned by a job when its --argument can't be used
+var errBatchArgument = errors.New("invalid argument")
+
+// batchJobFunc runs a job with the JSON --argument and returns its result
+type batchJobFunc func(argument string) (interface{}, error)
+
+type batchJob struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Argument    string `json:"argument"`
+	run         batchJobFunc
+}
+
+// batchResult is written in JSON on stdout at the end of each job
+type batchResult struct {
+	Job      string      `json:"job"`
+	Status   string      `json:"status"`
+	Duration string      `json:"duration"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+var batchJobs = map[string]batchJob{}
+
+// registerBatchJob makes a job available with --mode batch --job <name>
+// argument is an example of the JSON --argument, displayed by --job list
+func registerBatchJob(name, description, argument string, run batchJobFunc) {
+	name = strings.ToLower(name)
+	if _, exists := batchJobs[name]; exists {
+		log.Fatalf("[BATCH] ERROR : job %s is already registered", name)
+	}
+	batchJobs[name] = batchJob{Name: name, Description: description, Argument: argument, run: run}
+}
+
+// parseBatchArgument decodes the JSON --argument into v (v keeps its default values)
+func parseBatchArgument(argument string, v interface{}) error {
+	if len(strings.TrimSpace(argument)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(argument), v); err != nil {
+		return fmt.Errorf("%w: %s", errBatchArgument, err.Error())
+	}
+	return nil
+}
+
+func listBatchJobs() []batchJob {
+	jobs := make([]batchJob, 0, len(batchJobs))
+	for _, j := range batchJobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Name < jobs[k].Name })
+	return jobs
+}
+
+// runBatchJob runs the job, prints the result on stdout and returns the exit code
+func runBatchJob(name string, argument string) int {
+	name = strings.ToLower(name)
+	encoder := json.NewEncoder(os.Stdout)
+
+	if name == "list" {
+		_ = encoder.Encode(listBatchJobs())
+		return batchExitOK
+	}
+
+	l := newLogger("BATCH")
+	result := batchResult{Job: name}
+	j, ok := batchJobs[name]
+	if !ok {
+		l.Errorf("unknown job %s", name)
+		result.Status = "invalid"
+		result.Duration = "0s"
+		result.Error = "unknown job " + name + ", use --job list"
+		_ = encoder.Encode(result)
+		return batchExitInvalid
+	}
+
+	l.Infof("job=%s", name)
+	start := time.Now()
+	res, err := j.run(argument)
+	result.Duration = time.Since(start).String()
+	result.Result = res
+
+	exitCode := batchExitOK
+	switch {
+	case err == nil:
+		result.Status = "success"
+	case errors.Is(err, errBatchArgument):
+		result.Status = "invalid"
+		result.Error = err.Error()
+		exitCode = batchExitInvalid
+	default:
+		result.Status = "failed"
+		result.Error = err.Error()
+		exitCode = batchExitFailed
+	}
+	l.Infof("job=%s status=%s duration=%s", name, result.Status, result.Duration)
+	_ = encoder.Encode(result)
+	return exitCode
+}
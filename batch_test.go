@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// batchTestOutput runs the job and returns its exit code and its output on stdout
+func batchTestOutput(t *testing.T, name, argument string) (int, []byte) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	code := runBatchJob(name, argument)
+	os.Stdout = saved
+	w.Close()
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, output
+}
+
+func TestParseBatchArgument(t *testing.T) {
+	type argument struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	tests := []struct {
+		name     string
+		argument string
+		want     argument
+		invalid  bool
+	}{
+		{name: "empty keeps the defaults", argument: "", want: argument{"localhost", 3000}},
+		{name: "blank keeps the defaults", argument: "  ", want: argument{"localhost", 3000}},
+		{name: "partial", argument: `{"port": 8080}`, want: argument{"localhost", 8080}},
+		{name: "full", argument: `{"host": "db", "port": 5432}`, want: argument{"db", 5432}},
+		{name: "invalid JSON", argument: `{"host": `, want: argument{"localhost", 3000}, invalid: true},
+		{name: "wrong type", argument: `{"port": "80"}`, want: argument{"localhost", 3000}, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := argument{"localhost", 3000}
+			err := parseBatchArgument(test.argument, &got)
+			if errors.Is(err, errBatchArgument) != test.invalid || (err != nil && !test.invalid) {
+				t.Fatalf("error %v, invalid %v expected", err, test.invalid)
+			}
+			if got != test.want {
+				t.Fatalf("%+v, %+v expected", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunBatchJob(t *testing.T) {
+	batchJobs["test-ok"] = batchJob{Name: "test-ok", run: func(argument string) (interface{}, error) { return argument, nil }}
+	batchJobs["test-failed"] = batchJob{Name: "test-failed", run: func(string) (interface{}, error) { return nil, errors.New("connection refused") }}
+	batchJobs["test-invalid"] = batchJob{Name: "test-invalid", run: func(argument string) (interface{}, error) {
+		var v struct{}
+		return nil, parseBatchArgument(argument, &v)
+	}}
+	defer func() {
+		delete(batchJobs, "test-ok")
+		delete(batchJobs, "test-failed")
+		delete(batchJobs, "test-invalid")
+	}()
+
+	tests := []struct {
+		name     string
+		job      string
+		argument string
+		code     int
+		status   string
+		error    string
+	}{
+		{name: "success", job: "test-ok", argument: "ping", code: batchExitOK, status: "success"},
+		{name: "case insensitive", job: "TEST-OK", code: batchExitOK, status: "success"},
+		{name: "failed", job: "test-failed", code: batchExitFailed, status: "failed", error: "connection refused"},
+		{name: "invalid argument", job: "test-invalid", argument: "{", code: batchExitInvalid, status: "invalid",
+			error: "invalid argument: unexpected end of JSON input"},
+		{name: "unknown job", job: "unknown", code: batchExitInvalid, status: "invalid", error: "unknown job unknown, use --job list"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, output := batchTestOutput(t, test.job, test.argument)
+			if code != test.code {
+				t.Fatalf("exit code %d, %d expected", code, test.code)
+			}
+			var result batchResult
+			if err := json.Unmarshal(output, &result); err != nil {
+				t.Fatalf("%s : %s", err, output)
+			}
+			if result.Status != test.status || result.Error != test.error || len(result.Duration) == 0 {
+				t.Fatalf("result %+v", result)
+			}
+			if test.argument == "ping" && result.Result != "ping" {
+				t.Fatalf("result %v, the argument expected", result.Result)
+			}
+		})
+	}
+}
+
+func TestRunBatchJobList(t *testing.T) {
+	batchJobs["test-b"] = batchJob{Name: "test-b", Description: "second", Argument: `{"b": 2}`}
+	batchJobs["test-a"] = batchJob{Name: "test-a", Description: "first", Argument: `{"a": 1}`}
+	defer func() {
+		delete(batchJobs, "test-a")
+		delete(batchJobs, "test-b")
+	}()
+
+	code, output := batchTestOutput(t, "list", "")
+	if code != batchExitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	var jobs []batchJob
+	if err := json.Unmarshal(output, &jobs); err != nil {
+		t.Fatalf("%s : %s", err, output)
+	}
+	if len(jobs) != len(batchJobs) {
+		t.Fatalf("%d jobs, %d expected", len(jobs), len(batchJobs))
+	}
+	for i := 1; i < len(jobs); i++ {
+		if jobs[i-1].Name >= jobs[i].Name {
+			t.Fatalf("the jobs are not sorted : %s before %s", jobs[i-1].Name, jobs[i].Name)
+		}
+	}
+	for _, job := range jobs {
+		if job.Name == "test-a" && (job.Description != "first" || job.Argument != `{"a": 1}`) {
+			t.Fatalf("job %+v", job)
+		}
+	}
+}
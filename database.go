@@ -2,9 +2,8 @@ package main
 
 import (
 	"database/sql"
-	b64 "encoding/base64"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -13,49 +12,113 @@ import (
 	"github.com/gin-gonic/gin"
 	//"google.golang.org/genproto/googleapis/cloud/bigquery/connection/v1"
 
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
 	getenvs "gitlab.com/avarf/getenvs"
 )
 
-var (
-	db       *sql.DB
-)
+func init() {
+	registerBatchJob("db", "connect to a database (DB_* variables), see GET /v1/db for the engines", `{"engine": "mysql"} or {"target": "orders"}`, batchJobDB)
+}
 
 // --------------------------- Database
 
 // no swagger information
-func DBsqlconnect(engine string) (*sql.DB, error) {
-	User := os.Getenv("DB_USER")
-	Passwd := os.Getenv("DB_PASSWORD")
-	Host := os.Getenv("DB_HOST")
-	DBName := os.Getenv("DB_NAME")
-	Timeout := getenvs.GetEnvString("DB_TIMEOUT", "5")
-	var connection, Port string
-	switch engine {
-		case "mysql":
-			Port = getenvs.GetEnvString("DB_PORT", "3306")
-			connection = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?timeout=%ss",User,Passwd,Host,Port,DBName,Timeout)
-		case "postgres":
-			Port = getenvs.GetEnvString("DB_PORT", "5432")
-			connection = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s connect_timeout=%s sslmode=disable", Host, Port, User, Passwd, DBName, Timeout)
-	}
-	log.Printf("[%s] INFO : DB_USER=%s", strings.ToUpper(engine), User)
-	log.Printf("[%s] INFO : DB_PASSWORD=%s", strings.ToUpper(engine), b64.StdEncoding.EncodeToString([]byte(Passwd)))
-	log.Printf("[%s] INFO : DB_HOST=%s", strings.ToUpper(engine), Host)
-	log.Printf("[%s] INFO : DB_PORT=%s", strings.ToUpper(engine), Port)
-	log.Printf("[%s] INFO : DB_NAME=%s", strings.ToUpper(engine), DBName)
-	log.Printf("[%s] INFO : DB_TIMEOUT=%s", strings.ToUpper(engine), Timeout)
-	db, err := sql.Open(engine, connection)
+func DBsqlconnect(engine string, l *logger) (*sql.DB, error) {
+	e, err := getDBEngine(engine)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return nil, err
+	}
+	db, err := dbOpen(e, dbConfigFromEnv(e, "DB_"), l)
 	if err != nil {
-		log.Printf("[%s] ERROR : open=%s",strings.ToUpper(engine), err.Error())
+		return nil, err
 	}
 	// make sure connection is available
 	err = db.Ping()
 	if err != nil {
-		log.Printf("[%s] ERROR : ping=%s",strings.ToUpper(engine), err.Error())
+		l.Errorf("ping=%s", err.Error())
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// dbConfigFromEnv reads the connection parameters from the <prefix>* variables (ex: DB_USER)
+func dbConfigFromEnv(e *dbEngine, prefix string) dbConfig {
+	return dbConfig{
+		User:     os.Getenv(prefix + "USER"),
+		Password: os.Getenv(prefix + "PASSWORD"),
+		Host:     os.Getenv(prefix + "HOST"),
+		Port:     getenvs.GetEnvString(prefix+"PORT", e.DefaultPort),
+		Name:     os.Getenv(prefix + "NAME"),
+		Timeout:  getenvs.GetEnvString(prefix+"TIMEOUT", "5"),
+		TLS: dbTLSConfig{
+			Mode:       strings.ToLower(getenvs.GetEnvString(prefix+"TLS_MODE", dbTLSDisable)),
+			CA:         os.Getenv(prefix + "TLS_CA"),
+			Cert:       os.Getenv(prefix + "TLS_CERT"),
+			Key:        os.Getenv(prefix + "TLS_KEY"),
+			ServerName: os.Getenv(prefix + "TLS_SERVER_NAME"),
+		},
+	}
+}
+
+// dbOpen logs the parameters and opens the database (without connecting)
+func dbOpen(e *dbEngine, cfg dbConfig, l *logger) (*sql.DB, error) {
+	l.Debugf("DB_USER=%s", cfg.User)
+	l.Debugf("DB_PASSWORD=%s", maskSecret(cfg.Password))
+	l.Debugf("DB_HOST=%s", cfg.Host)
+	l.Debugf("DB_PORT=%s", cfg.Port)
+	l.Debugf("DB_NAME=%s", cfg.Name)
+	l.Debugf("DB_TIMEOUT=%s", cfg.Timeout)
+	l.Debugf("DB_TLS_MODE=%s", cfg.TLS.Mode)
+	dsn, err := e.dsn(cfg)
+	if err != nil {
+		l.Errorf("dsn=%s", err.Error())
+		return nil, err
 	}
-	return db, err
+	db, err := sql.Open(e.Driver, dsn)
+	if err != nil {
+		l.Errorf("open=%s", err.Error())
+		return nil, err
+	}
+	return db, nil
+}
+
+// dbQueryVersion returns the version of the database
+func dbQueryVersion(db *sql.DB, e *dbEngine, l *logger) (string, error) {
+	var version string
+	err := db.QueryRow(e.VersionQuery).Scan(&version)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return "", err
+	}
+	return version, nil
+}
+
+// dbCountRows returns the number of rows of the table
+func dbCountRows(db *sql.DB, table string, l *logger) (int, error) {
+	if err := validateDBIdentifier(table); err != nil {
+		l.Errorf("%s", err.Error())
+		return 0, err
+	}
+	request := "SELECT COUNT(*) AS COUNT FROM " + table
+	l.Infof("REQUEST: %s", request)
+	var count int
+	err := db.QueryRow(request).Scan(&count)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return 0, err
+	}
+	return count, nil
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db [get]
+// @summary List the supported database engines
+// @produce application/json
+// @success 200 {array} dbEngine
+func dbListHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, listDBEngines())
 }
 
 // ---- swagger Informations
@@ -64,26 +127,91 @@ func DBsqlconnect(engine string) (*sql.DB, error) {
 // @summary Test Database connection
 // @consume text/plain
 // @produce text/plain
-// @param engine path string true "Database Engine (ex: mysql, postgres...)"
+// @param engine path string true "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
+// @param format query string false "text (default) or json"
 // @success 200 string OK
 // @failure 500 string Internal Server Error
 func dbEngineHandler(c *gin.Context) {
 	engine := c.Param("engine")
-	db, err := DBsqlconnect(engine)
+	l := requestLogger(c, strings.ToUpper(engine))
+	e, err := getDBEngine(engine)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	db, err := DBsqlconnect(engine, l)
 	if err != nil {
-		log.Printf("[%s] ERROR : %s",strings.ToUpper(engine), err.Error())
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
-	var version string
-	err = db.QueryRow("SELECT VERSION()").Scan(&version)
+	defer db.Close()
+	version, err := dbQueryVersion(db, e, l)
 	if err != nil {
-		log.Printf("[%s] ERROR : %s",strings.ToUpper(engine), err.Error())
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
+	dbConnectionResponse(c, "", db, e, dbConfigFromEnv(e, "DB_"), version)
+}
+
+// dbConnectionResponse writes the version and the TLS report of the connection (JSON with ?format=json)
+func dbConnectionResponse(c *gin.Context, name string, db *sql.DB, e *dbEngine, cfg dbConfig, version string) {
+	tlsReport := newDBTLSReport(db, e, cfg)
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, gin.H{
+			"database": name,
+			"engine":   e.Name,
+			"version":  version,
+			"tls_mode": cfg.TLS.Mode,
+			"tls":      tlsReport,
+		})
+		return
+	}
+	msg := "Database connection OK (version: " + version + ")"
+	if len(name) > 0 {
+		msg = "Database " + name + " connection OK (version: " + version + ")"
+	}
+	if tlsReport != nil {
+		msg += "\n" + tlsReport.String()
+	}
+	c.String(http.StatusOK, msg)
+}
+
+// function for Job
+func batchJobDB(argValues string) (interface{}, error) {
+	var data struct {
+		Engine string `json:"engine"`
+		Target string `json:"target"`
+	}
+	data.Engine = "mysql"
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Target) > 0 {
+		t, err := getDBTarget(data.Target)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBatchArgument, err.Error())
+		}
+		version, err := t.version(newLogger("BATCH/DB/" + strings.ToUpper(t.Name)))
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{"target": t.Name, "engine": t.engine.Name, "version": version, "tls": newDBTLSReport(t.db, t.engine, t.cfg)}, nil
+	}
+	e, err := getDBEngine(data.Engine)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBatchArgument, err.Error())
+	}
+	l := newLogger("BATCH/" + strings.ToUpper(data.Engine))
+	db, err := DBsqlconnect(data.Engine, l)
+	if err != nil {
+		return nil, err
+	}
 	defer db.Close()
-	c.String(http.StatusOK, "Database connection OK (version: "+version+")")
+	version, err := dbQueryVersion(db, e, l)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{"engine": data.Engine, "version": version, "tls": newDBTLSReport(db, e, dbConfigFromEnv(e, "DB_"))}, nil
 }
 
 // ---- swagger Informations
@@ -92,31 +220,35 @@ func dbEngineHandler(c *gin.Context) {
 // @summary Count lines in tables
 // @consume text/plain
 // @produce text/plain
-// @param engine path string true "Database Engine (ex: mysql, postgres...)"
+// @param engine path string true "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
 // @param table path string true "Table name"
 // @success 200 string OK
 // @failure 500 string Internal Server Error
 func dbHandlerCountRowTable(c *gin.Context) {
 	engine := c.Param("engine")
-	db, err := DBsqlconnect(engine)
+	l := requestLogger(c, strings.ToUpper(engine))
+	db, err := DBsqlconnect(engine, l)
 	if err != nil {
-		log.Printf("[%s] ERROR : %s",strings.ToUpper(engine), err.Error())
+		if errors.Is(err, errDBUnknownEngine) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer db.Close()
 	table := c.Param("table")
-	request := "SELECT COUNT(*) AS COUNT FROM " + table + ";"
-	log.Printf("[%s] REQUEST: %s" ,strings.ToUpper(engine),request)
-	var count int
-	err = db.QueryRow(request).Scan(&count)
+	count, err := dbCountRows(db, table, l)
 	if err != nil {
-		log.Printf("[%s] ERROR : %s",strings.ToUpper(engine), err.Error())
+		if errors.Is(err, errDBQueryArgument) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
-	defer db.Close()
 	msg := strconv.Itoa(count) + " row(s) found in table " + strings.ToUpper(table)
-	log.Printf("[%s] MSG: %s" ,strings.ToUpper(engine),msg)
+	l.Infof("%s", msg)
 	c.String(http.StatusOK, msg)
 }
 
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- Database bench
+
+var (
+	dbBenchConnectDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "macgover_db_bench_connect_duration_seconds",
+		Help:    "Connection time of the database bench.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"database", "engine"})
+	dbBenchQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "macgover_db_bench_query_duration_seconds",
+		Help:    "Round trip time of the queries of the database bench.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"database", "engine", "mode"})
+	dbBenchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "macgover_db_bench_errors_total",
+		Help: "Number of failed queries of the database bench.",
+	}, []string{"database", "engine", "mode"})
+)
+
+// dbBenchOptions are the parameters of a bench
+type dbBenchOptions struct {
+	Count       int    `json:"count"`
+	Concurrency int    `json:"concurrency"`
+	Mode        string `json:"mode"` // ping or select
+}
+
+type dbBenchLatency struct {
+	Min string `json:"min"`
+	Avg string `json:"avg"`
+	P50 string `json:"p50"`
+	P95 string `json:"p95"`
+	P99 string `json:"p99"`
+	Max string `json:"max"`
+}
+
+type dbBenchResult struct {
+	Database         string         `json:"database"`
+	Engine           string         `json:"engine"`
+	Mode             string         `json:"mode"`
+	Count            int            `json:"count"`
+	Concurrency      int            `json:"concurrency"`
+	ConnectTime      string         `json:"connect_time"`
+	TotalTime        string         `json:"total_time"`
+	QueriesPerSecond float64        `json:"queries_per_second"`
+	Errors           int            `json:"errors"`
+	LastError        string         `json:"last_error,omitempty"`
+	Latency          dbBenchLatency `json:"latency"`
+}
+
+func init() {
+	prometheus.MustRegister(dbBenchConnectDuration, dbBenchQueryDuration, dbBenchErrors)
+
+	registerBatchJob("dbbench", "run N ping/SELECT 1 round trips on a database and report the latency", `{"engine": "mysql", "count": 100, "concurrency": 4, "mode": "select"} or {"target": "orders"}`, batchJobDBBench)
+}
+
+// validate applies the default values and the limits (DB_BENCH_MAX_COUNT, DB_BENCH_MAX_CONCURRENCY)
+func (o *dbBenchOptions) validate() error {
+	maxCount, _ := strconv.Atoi(getenvs.GetEnvString("DB_BENCH_MAX_COUNT", "10000"))
+	maxConcurrency, _ := strconv.Atoi(getenvs.GetEnvString("DB_BENCH_MAX_CONCURRENCY", "50"))
+	if o.Count == 0 {
+		o.Count = 10
+	}
+	if o.Concurrency == 0 {
+		o.Concurrency = 1
+	}
+	if len(o.Mode) == 0 {
+		o.Mode = "select"
+	}
+	o.Mode = strings.ToLower(o.Mode)
+	switch {
+	case o.Count < 0 || o.Count > maxCount:
+		return fmt.Errorf("%w: count must be between 1 and %d", errBatchArgument, maxCount)
+	case o.Concurrency < 0 || o.Concurrency > maxConcurrency:
+		return fmt.Errorf("%w: concurrency must be between 1 and %d", errBatchArgument, maxConcurrency)
+	case o.Mode != "ping" && o.Mode != "select":
+		return fmt.Errorf("%w: mode must be ping or select", errBatchArgument)
+	}
+	if o.Concurrency > o.Count {
+		o.Concurrency = o.Count
+	}
+	return nil
+}
+
+// dbPercentile returns the percentile p of the sorted durations
+func dbPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// dbBench opens new connections to the database (not the pool of the targets)
+// and runs the round trips with opts.Concurrency workers
+func dbBench(name string, e *dbEngine, cfg dbConfig, opts dbBenchOptions, l *logger) (*dbBenchResult, error) {
+	result := &dbBenchResult{Database: name, Engine: e.Name, Mode: opts.Mode, Count: opts.Count, Concurrency: opts.Concurrency}
+
+	start := time.Now()
+	db, err := dbOpen(e, cfg, l)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(opts.Concurrency)
+	db.SetMaxIdleConns(opts.Concurrency)
+	if err := db.Ping(); err != nil {
+		l.Errorf("ping=%s", err.Error())
+		return nil, err
+	}
+	connectTime := time.Since(start)
+	result.ConnectTime = connectTime.String()
+	dbBenchConnectDuration.WithLabelValues(name, e.Name).Observe(connectTime.Seconds())
+
+	timeout, err := time.ParseDuration(getenvs.GetEnvString("DB_QUERY_TIMEOUT", "10s"))
+	if err != nil {
+		timeout = 10 * time.Second
+	}
+	roundTrip := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if opts.Mode == "ping" {
+			return db.PingContext(ctx)
+		}
+		var one int
+		return db.QueryRowContext(ctx, e.pingQuery).Scan(&one)
+	}
+
+	l.Infof("bench mode=%s count=%d concurrency=%d", opts.Mode, opts.Count, opts.Concurrency)
+	var (
+		mu        sync.Mutex
+		durations = make([]time.Duration, 0, opts.Count)
+		wg        sync.WaitGroup
+		jobs      = make(chan struct{})
+	)
+	start = time.Now()
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				t := time.Now()
+				err := roundTrip()
+				d := time.Since(t)
+				mu.Lock()
+				if err != nil {
+					result.Errors++
+					result.LastError = err.Error()
+					dbBenchErrors.WithLabelValues(name, e.Name, opts.Mode).Inc()
+				} else {
+					durations = append(durations, d)
+					dbBenchQueryDuration.WithLabelValues(name, e.Name, opts.Mode).Observe(d.Seconds())
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < opts.Count; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	total := time.Since(start)
+
+	result.TotalTime = total.String()
+	result.QueriesPerSecond = float64(opts.Count) / total.Seconds()
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, k int) bool { return durations[i] < durations[k] })
+		var sum time.Duration
+		for _, d := range durations {
+			sum += d
+		}
+		result.Latency = dbBenchLatency{
+			Min: durations[0].String(),
+			Avg: (sum / time.Duration(len(durations))).String(),
+			P50: dbPercentile(durations, 50).String(),
+			P95: dbPercentile(durations, 95).String(),
+			P99: dbPercentile(durations, 99).String(),
+			Max: durations[len(durations)-1].String(),
+		}
+	}
+	if result.Errors > 0 {
+		l.Errorf("bench %d error(s), last=%s", result.Errors, result.LastError)
+	}
+	l.Infof("bench connect=%s total=%s p50=%s p99=%s", result.ConnectTime, result.TotalTime, result.Latency.P50, result.Latency.P99)
+	return result, nil
+}
+
+// dbBenchSource returns the engine and the parameters of the :name target or of the :engine,
+// with the component of the logs
+func dbBenchSource(engine string, target string) (string, *dbEngine, dbConfig, string, error) {
+	if len(target) > 0 {
+		t, err := getDBTarget(target)
+		if err != nil {
+			return "", nil, dbConfig{}, "", err
+		}
+		return t.Name, t.engine, t.cfg, "DB/" + strings.ToUpper(t.Name), nil
+	}
+	e, err := getDBEngine(engine)
+	if err != nil {
+		return "", nil, dbConfig{}, "", err
+	}
+	return e.Name, e, dbConfigFromEnv(e, "DB_"), strings.ToUpper(e.Name), nil
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/{engine}/bench [get]
+// @router /v1/db/target/{name}/bench [get]
+// @summary Run N ping/SELECT 1 round trips and report the latency
+// @produce application/json
+// @param engine path string false "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
+// @param name path string false "Target name (see DB_TARGETS)"
+// @param count query int false "Number of round trips (default 10)"
+// @param concurrency query int false "Number of concurrent connections (default 1)"
+// @param mode query string false "ping or select (default)"
+// @success 200 {object} dbBenchResult
+// @failure 400 string Bad request
+// @failure 404 string Not Found
+// @failure 500 string Internal Server Error
+func dbBenchHandler(c *gin.Context) {
+	name, e, cfg, component, err := dbBenchSource(c.Param("engine"), c.Param("name"))
+	if err != nil {
+		if errors.Is(err, errDBUnknownTarget) {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	var opts dbBenchOptions
+	opts.Count, _ = strconv.Atoi(c.Query("count"))
+	opts.Concurrency, _ = strconv.Atoi(c.Query("concurrency"))
+	opts.Mode = c.Query("mode")
+	if err := opts.validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := dbBench(name, e, cfg, opts, requestLogger(c, component))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// function for Job
+func batchJobDBBench(argValues string) (interface{}, error) {
+	var data struct {
+		Engine string `json:"engine"`
+		Target string `json:"target"`
+		dbBenchOptions
+	}
+	data.Engine = "mysql"
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		return nil, err
+	}
+	if err := data.dbBenchOptions.validate(); err != nil {
+		return nil, err
+	}
+	name, e, cfg, component, err := dbBenchSource(data.Engine, data.Target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBatchArgument, err.Error())
+	}
+	result, err := dbBench(name, e, cfg, data.dbBenchOptions, newLogger("BATCH/"+component))
+	if err != nil {
+		return nil, err
+	}
+	if result.Errors > 0 {
+		return result, fmt.Errorf("%d error(s) during the bench: %s", result.Errors, result.LastError)
+	}
+	return result, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDBPercentile(t *testing.T) {
+	ten := []time.Duration{}
+	for i := 1; i <= 10; i++ {
+		ten = append(ten, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{"empty", nil, 50, 0},
+		{"one value", []time.Duration{time.Second}, 99, time.Second},
+		{"p0", ten, 0, time.Millisecond},
+		{"p50", ten, 50, 5 * time.Millisecond},
+		{"p90", ten, 90, 9 * time.Millisecond},
+		{"p95 rounded", ten, 95, 10 * time.Millisecond},
+		{"p99", ten, 99, 10 * time.Millisecond},
+		{"p100", ten, 100, 10 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := dbPercentile(test.sorted, test.p); got != test.want {
+				t.Fatalf("%s, %s expected", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+	goora "github.com/sijms/go-ora/v2"
+	"github.com/sijms/go-ora/v2/network"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// --------------------------- Database engines
+
+// errDBUnknownEngine is returned when the :engine is not registered
+var errDBUnknownEngine = errors.New("unsupported database engine")
+
+// dbConfig contains the connection parameters (DB_* variables)
+type dbConfig struct {
+	User     string
+	Password string
+	Host     string
+	Port     string
+	Name     string
+	Timeout  string
+	TLS      dbTLSConfig
+}
+
+// dbEngine describes how to connect to one kind of database
+type dbEngine struct {
+	Name         string   `json:"name"`
+	Aliases      []string `json:"aliases,omitempty"`
+	Driver       string   `json:"driver"`
+	DefaultPort  string   `json:"default_port,omitempty"`
+	VersionQuery string   `json:"version_query"`
+	// Placeholder of the query parameters: "?", "$" ($1), "@p" (@p1) or ":" (:1)
+	Placeholder string `json:"placeholder"`
+	// ReadOnlyTx is true when the driver supports sql.TxOptions{ReadOnly: true}
+	ReadOnlyTx bool `json:"read_only_tx"`
+	// readOnlySQL is run at the beginning of the transaction when ReadOnlyTx is false
+	readOnlySQL string
+	// readOnlyResetSQL is run on the connection after the transaction when readOnlySQL is not transactional
+	readOnlyResetSQL string
+	// backslashEscapes is true when \ escapes the next character in the quoted strings (mysql)
+	backslashEscapes bool
+	// pingQuery is the round trip of the bench
+	pingQuery string
+	catalog   *dbCatalog
+	// duplicateKey is true when the error is the violation of a primary key or of a unique constraint
+	duplicateKey func(err error) bool
+	// sessionTLS reads the TLS of the session of the driver (nil when not available)
+	sessionTLS dbSessionTLS
+	// startTLS negotiates TLS on a new connection to read the certificates of the server (nil when not available)
+	startTLS func(conn net.Conn) error
+	dsn      func(cfg dbConfig) (string, error)
+}
+
+var (
+	dbEngines       = map[string]*dbEngine{}
+	dbEngineAliases = map[string]string{}
+)
+
+// registerDBEngine makes an engine available for /v1/db/:engine
+func registerDBEngine(e *dbEngine) {
+	if len(e.pingQuery) == 0 {
+		e.pingQuery = "SELECT 1"
+	}
+	dbEngines[e.Name] = e
+	for _, alias := range e.Aliases {
+		dbEngineAliases[alias] = e.Name
+	}
+}
+
+// getDBEngine returns the engine registered for the name or one of its aliases
+func getDBEngine(name string) (*dbEngine, error) {
+	name = strings.ToLower(name)
+	if alias, ok := dbEngineAliases[name]; ok {
+		name = alias
+	}
+	e, ok := dbEngines[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errDBUnknownEngine, name)
+	}
+	return e, nil
+}
+
+func listDBEngines() []*dbEngine {
+	engines := make([]*dbEngine, 0, len(dbEngines))
+	for _, e := range dbEngines {
+		engines = append(engines, e)
+	}
+	sort.Slice(engines, func(i, k int) bool { return engines[i].Name < engines[k].Name })
+	return engines
+}
+
+func init() {
+	registerDBEngine(&dbEngine{
+		Name:             "mysql",
+		Aliases:          []string{"mariadb"},
+		Driver:           "mysql",
+		DefaultPort:      "3306",
+		VersionQuery:     "SELECT VERSION()",
+		Placeholder:      "?",
+		ReadOnlyTx:       true,
+		backslashEscapes: true,
+		catalog:          mysqlCatalog,
+		duplicateKey:     mysqlDuplicateKey,
+		sessionTLS:       mysqlSessionTLS,
+		startTLS:         mysqlStartTLS,
+		dsn: func(cfg dbConfig) (string, error) {
+			dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?timeout=%ss", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name, cfg.Timeout)
+			config, err := cfg.TLS.tlsConfig(cfg.Host)
+			if err != nil || config == nil {
+				return dsn, err
+			}
+			key := cfg.TLS.registrationKey(cfg.Host, cfg.Port)
+			if err := mysql.RegisterTLSConfig(key, config); err != nil {
+				return "", err
+			}
+			return dsn + "&tls=" + url.QueryEscape(key), nil
+		},
+	})
+	registerDBEngine(&dbEngine{
+		Name:         "postgres",
+		Aliases:      []string{"postgresql", "pgsql"},
+		Driver:       "postgres",
+		DefaultPort:  "5432",
+		VersionQuery: "SELECT VERSION()",
+		Placeholder:  "$",
+		ReadOnlyTx:   true,
+		catalog:      postgresCatalog,
+		duplicateKey: postgresDuplicateKey,
+		sessionTLS:   postgresSessionTLS,
+		startTLS:     postgresStartTLS,
+		dsn: func(cfg dbConfig) (string, error) {
+			if err := cfg.TLS.validate(); err != nil {
+				return "", err
+			}
+			sslmode := cfg.TLS.Mode
+			if len(sslmode) == 0 {
+				sslmode = dbTLSDisable
+			}
+			params := [][2]string{
+				{"host", cfg.Host}, {"port", cfg.Port}, {"user", cfg.User}, {"password", cfg.Password}, {"dbname", cfg.Name},
+				{"connect_timeout", cfg.Timeout}, {"sslmode", sslmode},
+			}
+			if len(cfg.TLS.CA) > 0 {
+				params = append(params, [2]string{"sslrootcert", cfg.TLS.CA})
+			}
+			if len(cfg.TLS.Cert) > 0 {
+				params = append(params, [2]string{"sslcert", cfg.TLS.Cert}, [2]string{"sslkey", cfg.TLS.Key})
+			}
+			dsn := make([]string, 0, len(params))
+			for _, p := range params {
+				dsn = append(dsn, p[0]+"="+postgresQuote(p[1]))
+			}
+			return strings.Join(dsn, " "), nil
+		},
+	})
+	// sqlserver has no read-only transaction : the query runs in a transaction which is always rolled back (the writes
+	// are undone) and the allow-list refuses the writes, the locks and COMMIT, use a login without write permission
+	registerDBEngine(&dbEngine{
+		Name:         "sqlserver",
+		Aliases:      []string{"mssql"},
+		Driver:       "sqlserver",
+		DefaultPort:  "1433",
+		VersionQuery: "SELECT @@VERSION",
+		Placeholder:  "@p",
+		catalog:      sqlserverCatalog,
+		duplicateKey: sqlserverDuplicateKey,
+		sessionTLS:   sqlserverSessionTLS,
+		dsn: func(cfg dbConfig) (string, error) {
+			if err := cfg.TLS.validate(); err != nil {
+				return "", err
+			}
+			query := url.Values{}
+			query.Add("database", cfg.Name)
+			query.Add("dial timeout", cfg.Timeout)
+			if cfg.TLS.enabled() {
+				if len(cfg.TLS.Cert) > 0 {
+					return "", fmt.Errorf("%w: client certificate with sqlserver", errDBTLSNotSupported)
+				}
+				query.Add("encrypt", "true")
+				switch cfg.TLS.Mode {
+				case dbTLSRequire:
+					query.Add("TrustServerCertificate", "true")
+				case dbTLSVerifyFull:
+					query.Add("hostNameInCertificate", cfg.Host)
+					if len(cfg.TLS.ServerName) > 0 {
+						query.Set("hostNameInCertificate", cfg.TLS.ServerName)
+					}
+				}
+				if len(cfg.TLS.CA) > 0 && cfg.TLS.Mode != dbTLSRequire {
+					query.Add("certificate", cfg.TLS.CA)
+				}
+			}
+			u := &url.URL{
+				Scheme:   "sqlserver",
+				User:     url.UserPassword(cfg.User, cfg.Password),
+				Host:     cfg.Host + ":" + cfg.Port,
+				RawQuery: query.Encode(),
+			}
+			return u.String(), nil
+		},
+	})
+	registerDBEngine(&dbEngine{
+		Name:         "oracle",
+		Driver:       "oracle",
+		DefaultPort:  "1521",
+		VersionQuery: "SELECT BANNER FROM V$VERSION WHERE ROWNUM = 1",
+		Placeholder:  ":",
+		readOnlySQL:  "SET TRANSACTION READ ONLY",
+		pingQuery:    "SELECT 1 FROM DUAL",
+		catalog:      oracleCatalog,
+		duplicateKey: oracleDuplicateKey,
+		sessionTLS:   oracleSessionTLS,
+		startTLS:     oracleStartTLS,
+		dsn: func(cfg dbConfig) (string, error) {
+			if err := cfg.TLS.validate(); err != nil {
+				return "", err
+			}
+			port, _ := strconv.Atoi(cfg.Port)
+			options := map[string]string{
+				"CONNECTION TIMEOUT": cfg.Timeout,
+			}
+			if cfg.TLS.enabled() {
+				// go-ora reads the CA and the client certificate in a wallet only
+				if len(cfg.TLS.CA) > 0 || len(cfg.TLS.Cert) > 0 {
+					return "", fmt.Errorf("%w: CA bundle or client certificate with oracle", errDBTLSNotSupported)
+				}
+				options["SSL"] = "enable"
+				options["SSL VERIFY"] = strconv.FormatBool(cfg.TLS.Mode != dbTLSRequire)
+			}
+			// DB_NAME is the service name
+			return goora.BuildUrl(cfg.Host, port, cfg.Name, cfg.User, cfg.Password, options), nil
+		},
+	})
+	registerDBEngine(&dbEngine{
+		Name:         "sqlite",
+		Aliases:      []string{"sqlite3"},
+		Driver:       "sqlite",
+		VersionQuery: "SELECT sqlite_version()",
+		Placeholder:  "?",
+		// the driver ignores sql.TxOptions{ReadOnly: true} (plain BEGIN)
+		readOnlySQL:      "PRAGMA query_only = ON",
+		readOnlyResetSQL: "PRAGMA query_only = OFF",
+		catalog:          sqliteCatalog,
+		duplicateKey:     sqliteDuplicateKey,
+		dsn: func(cfg dbConfig) (string, error) {
+			if cfg.TLS.enabled() {
+				return "", fmt.Errorf("%w: sqlite is a local file", errDBTLSNotSupported)
+			}
+			// DB_NAME is the path of the database file
+			timeout, _ := strconv.Atoi(cfg.Timeout)
+			return fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)", cfg.Name, timeout*1000), nil
+		},
+	})
+}
+
+func mysqlDuplicateKey(err error) bool {
+	var e *mysql.MySQLError
+	return errors.As(err, &e) && e.Number == 1062 // ER_DUP_ENTRY
+}
+
+func postgresDuplicateKey(err error) bool {
+	var e *pq.Error
+	return errors.As(err, &e) && e.Code == "23505" // unique_violation
+}
+
+func sqlserverDuplicateKey(err error) bool {
+	var e mssql.Error
+	return errors.As(err, &e) && (e.Number == 2627 || e.Number == 2601) // constraint or unique index
+}
+
+func oracleDuplicateKey(err error) bool {
+	var e *network.OracleError
+	return errors.As(err, &e) && e.ErrCode == 1 // ORA-00001
+}
+
+func sqliteDuplicateKey(err error) bool {
+	var e *sqlite.Error
+	return errors.As(err, &e) && (e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE)
+}
+
+// postgresQuote quotes a value of a key=value connection string (libpq rules: '...' with \' and \\)
+func postgresQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
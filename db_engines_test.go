@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostgresQuote(t *testing.T) {
+	tests := map[string]string{
+		"":                  "''",
+		"secret":            "'secret'",
+		"with space":        "'with space'",
+		"it's":              `'it\'s'`,
+		`back\slash`:        `'back\\slash'`,
+		"x sslmode=disable": "'x sslmode=disable'",
+	}
+	for value, want := range tests {
+		if got := postgresQuote(value); got != want {
+			t.Errorf("postgresQuote(%q) = %s, %s expected", value, got, want)
+		}
+	}
+}
+
+// the fake server reads the startup message and asks the password in clear text, the driver
+// must send the values of the configuration without extra parameters
+func TestPostgresDSN(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan map[string]string, 1)
+	go func() {
+		params := map[string]string{}
+		defer func() { received <- params }()
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		var length int32
+		if binary.Read(conn, binary.BigEndian, &length) != nil {
+			return
+		}
+		startup := make([]byte, length-4)
+		if _, err := io.ReadFull(conn, startup); err != nil {
+			return
+		}
+		fields := strings.Split(strings.TrimRight(string(startup[4:]), "\x00"), "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			params[fields[i]] = fields[i+1]
+		}
+		// AuthenticationCleartextPassword
+		if _, err := conn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 3}); err != nil {
+			return
+		}
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil || header[0] != 'p' {
+			return
+		}
+		password := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return
+		}
+		params["password"] = string(bytes.TrimRight(password, "\x00"))
+	}()
+
+	e, err := getDBEngine("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	cfg := dbConfig{User: "o'neil", Password: `p@ss word' sslmode='require \x`, Host: host, Port: port, Name: "my db", Timeout: "2"}
+	dsn, err := e.dsn(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(e.Driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = db.PingContext(ctx)
+
+	listener.Close()
+	params := <-received
+	if params["user"] != cfg.User || params["database"] != cfg.Name || params["password"] != cfg.Password {
+		t.Fatalf("parameters received %v", params)
+	}
+}
+
+// the TLS configs of the targets on the same host and port are registered under different keys
+func TestMySQLDSNTLSKey(t *testing.T) {
+	e, err := getDBEngine("mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(tlsConfig dbTLSConfig) string {
+		dsn, err := e.dsn(dbConfig{User: "u", Password: "p", Host: "db", Port: "3306", Name: "app", Timeout: "2", TLS: tlsConfig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dsn[strings.Index(dsn, "&tls="):]
+	}
+	require := key(dbTLSConfig{Mode: dbTLSRequire})
+	if require != key(dbTLSConfig{Mode: dbTLSRequire}) {
+		t.Fatalf("the same config has two keys")
+	}
+	if other := key(dbTLSConfig{Mode: dbTLSRequire, ServerName: "db.example.com"}); other == require {
+		t.Fatalf("two configs share the key %s", other)
+	}
+	if other := key(dbTLSConfig{Mode: dbTLSVerifyFull}); other == require {
+		t.Fatalf("two modes share the key %s", other)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- Database read-only queries
+
+var (
+	errDBUnknownQuery  = errors.New("unknown query")
+	errDBQueryArgument = errors.New("invalid query argument")
+)
+
+// identifiers: table, schema.table (no quotes, no spaces)
+var dbIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]{0,127}(\.[A-Za-z_][A-Za-z0-9_$]{0,127})?$`)
+
+// statements which write or lock, refused outside the quoted strings and comments: the read-only transaction is
+// not available with every driver (sqlserver), a WITH ... DELETE would run in the rolled back transaction and
+// COMMIT would end it, the locks (FOR UPDATE, FOR SHARE, LOCK IN SHARE MODE, WITH (UPDLOCK) ...) block the writers
+var dbWriteKeywordRegexp = regexp.MustCompile(`(?i)\b(INSERT|UPDATE|DELETE|MERGE|UPSERT|INTO|CREATE|ALTER|DROP|TRUNCATE|GRANT|REVOKE|EXEC|EXECUTE|CALL|PRAGMA|ATTACH|DETACH|VACUUM|COMMIT|ROLLBACK|LOCK|SHARE|UPDLOCK|XLOCK|HOLDLOCK|TABLOCK|TABLOCKX|ROWLOCK|PAGLOCK)\b`)
+
+// dbNamedQuery is a query of the allow-list (DB_QUERIES_FILE)
+//   - values are bound with "?" and are read in the query string by the names of Params
+//   - identifiers are written {name} in the SQL and are read in the query string by the names of Identifiers
+type dbNamedQuery struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	SQL         string   `json:"sql"`
+	Params      []string `json:"params,omitempty"`
+	Identifiers []string `json:"identifiers,omitempty"`
+	Engines     []string `json:"engines,omitempty"`
+}
+
+type dbQueryResult struct {
+	Query     string          `json:"query"`
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	RowCount  int             `json:"row_count"`
+	Truncated bool            `json:"truncated"`
+	Duration  string          `json:"duration"`
+}
+
+var (
+	dbQueries     = map[string]*dbNamedQuery{}
+	dbQueriesOnce sync.Once
+)
+
+// initDBQueries loads the built-in queries and DB_QUERIES_FILE (only once)
+func initDBQueries() {
+	dbQueriesOnce.Do(func() {
+		l := newLogger("DB/QUERY")
+		queries := []*dbNamedQuery{
+			{Name: "count", Description: "number of rows of a table", SQL: "SELECT COUNT(*) AS COUNT FROM {table}", Identifiers: []string{"table"}},
+		}
+		if file := os.Getenv("DB_QUERIES_FILE"); len(file) > 0 {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				l.Errorf("%s", err.Error())
+			} else {
+				var fileQueries []*dbNamedQuery
+				if err := json.Unmarshal(content, &fileQueries); err != nil {
+					l.Errorf("%s : %s", file, err.Error())
+				}
+				queries = append(queries, fileQueries...)
+			}
+		}
+		for _, q := range queries {
+			if err := validateDBNamedQuery(q); err != nil {
+				l.Errorf("query %s ignored : %s", q.Name, err.Error())
+				continue
+			}
+			dbQueries[q.Name] = q
+			l.Infof("query %s declared", q.Name)
+		}
+	})
+}
+
+// validateDBNamedQuery accepts only one SELECT (or WITH ... SELECT) statement without write keywords
+// the query is checked without and with the backslash escapes when it can run on mysql (NO_BACKSLASH_ESCAPES
+// is a setting of the server)
+func validateDBNamedQuery(q *dbNamedQuery) error {
+	if len(q.Name) == 0 {
+		return errors.New("name is required")
+	}
+	q.SQL = strings.TrimSuffix(strings.TrimSpace(q.SQL), ";")
+	upper := strings.ToUpper(q.SQL)
+	if !strings.HasPrefix(upper, "SELECT ") && !strings.HasPrefix(upper, "WITH ") {
+		return errors.New("only SELECT queries are allowed")
+	}
+	backslash := len(q.Engines) == 0
+	for _, engine := range q.Engines {
+		if e, err := getDBEngine(engine); err == nil && e.backslashEscapes {
+			backslash = true
+		}
+	}
+	if err := validateDBQueryCode(q, false); err != nil {
+		return err
+	}
+	if backslash {
+		if err := validateDBQueryCode(q, true); err != nil {
+			return err
+		}
+	}
+	for _, id := range q.Identifiers {
+		if !strings.Contains(q.SQL, "{"+id+"}") {
+			return fmt.Errorf("identifier {%s} not found in sql", id)
+		}
+	}
+	return nil
+}
+
+// validateDBQueryCode checks the statements, the keywords and the placeholders outside the strings and the comments
+func validateDBQueryCode(q *dbNamedQuery, backslash bool) error {
+	var code strings.Builder
+	placeholders := 0
+	dbScanSQL(q.SQL, backslash, func(r rune, isCode bool) {
+		if !isCode {
+			r = ' '
+		}
+		if r == '?' {
+			placeholders++
+		}
+		code.WriteRune(r)
+	})
+	if strings.Contains(code.String(), ";") {
+		return errors.New("only one statement is allowed")
+	}
+	if keyword := dbWriteKeywordRegexp.FindString(code.String()); len(keyword) > 0 {
+		return fmt.Errorf("%s is not allowed in a read-only query", strings.ToUpper(keyword))
+	}
+	if placeholders != len(q.Params) {
+		return errors.New("the number of ? and params are different")
+	}
+	return nil
+}
+
+func getDBNamedQuery(name string, e *dbEngine) (*dbNamedQuery, error) {
+	initDBQueries()
+	q, ok := dbQueries[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errDBUnknownQuery, name)
+	}
+	if len(q.Engines) > 0 {
+		for _, engine := range q.Engines {
+			if alias, err := getDBEngine(engine); err == nil && alias == e {
+				return q, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %s is not available for %s", errDBUnknownQuery, name, e.Name)
+	}
+	return q, nil
+}
+
+func listDBNamedQueries() []*dbNamedQuery {
+	initDBQueries()
+	queries := make([]*dbNamedQuery, 0, len(dbQueries))
+	for _, q := range dbQueries {
+		queries = append(queries, q)
+	}
+	sort.Slice(queries, func(i, k int) bool { return queries[i].Name < queries[k].Name })
+	return queries
+}
+
+// validateDBIdentifier rejects everything but a (schema.)table name
+func validateDBIdentifier(identifier string) error {
+	if !dbIdentifierRegexp.MatchString(identifier) {
+		return fmt.Errorf("%w: %q is not a valid identifier", errDBQueryArgument, identifier)
+	}
+	return nil
+}
+
+// dbScanSQL calls visit for each rune of the query, isCode is false in the quoted strings ('...', "...")
+// and in the comments (-- ..., /* ... */), with backslash a \ escapes the next character in the strings (mysql)
+func dbScanSQL(query string, backslash bool, visit func(r rune, isCode bool)) {
+	runes := []rune(query)
+	var state rune // 0 (code), '\'', '"', '-' (comment -- ...) or '*' (comment /* ... */)
+	start := 0
+	escaped := false
+	for i, r := range runes {
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case escaped:
+			escaped = false
+		case backslash && (state == '\'' || state == '"') && r == '\\':
+			escaped = true
+		case state == 0 && (r == '\'' || r == '"'):
+			// a doubled quote ('') closes and opens the string again
+			state = r
+		case state == 0 && r == '-' && next == '-':
+			state = '-'
+		case state == 0 && r == '/' && next == '*':
+			state, start = '*', i
+		case state == 0:
+			visit(r, true)
+			continue
+		case (state == '\'' || state == '"') && r == state:
+			state = 0
+		case state == '-' && r == '\n':
+			state = 0
+		case state == '*' && r == '/' && i > start+2 && runes[i-1] == '*':
+			state = 0
+		}
+		visit(r, false)
+	}
+}
+
+// dbRebind replaces the ? of the query by the placeholders of the engine
+func dbRebind(e *dbEngine, query string) string {
+	if e.Placeholder == "?" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	dbScanSQL(query, e.backslashEscapes, func(r rune, isCode bool) {
+		if r == '?' && isCode {
+			n++
+			b.WriteString(e.Placeholder + strconv.Itoa(n))
+			return
+		}
+		b.WriteRune(r)
+	})
+	return b.String()
+}
+
+// build returns the SQL and the arguments of the query, read in values
+func (q *dbNamedQuery) build(e *dbEngine, values func(string) string) (string, []interface{}, error) {
+	query := q.SQL
+	for _, id := range q.Identifiers {
+		value := values(id)
+		if err := validateDBIdentifier(value); err != nil {
+			return "", nil, err
+		}
+		query = strings.ReplaceAll(query, "{"+id+"}", value)
+	}
+	args := make([]interface{}, 0, len(q.Params))
+	for _, p := range q.Params {
+		args = append(args, values(p))
+	}
+	return dbRebind(e, query), args, nil
+}
+
+// dbRunReadOnlyQuery runs the query in a read-only transaction (always rolled back)
+func dbRunReadOnlyQuery(db *sql.DB, e *dbEngine, q *dbNamedQuery, values func(string) string, limit int, l *logger) (*dbQueryResult, error) {
+	query, args, err := q.build(e, values)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := time.ParseDuration(getenvs.GetEnvString("DB_QUERY_TIMEOUT", "10s"))
+	if err != nil {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return nil, err
+	}
+	defer conn.Close()
+	if len(e.readOnlyResetSQL) > 0 {
+		// after the rollback, the connection returns to the pool in read-write mode (or is discarded)
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), e.readOnlyResetSQL); err != nil {
+				l.Errorf("read write=%s", err.Error())
+				_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			}
+		}()
+	}
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: e.ReadOnlyTx})
+	if err != nil {
+		l.Errorf("begin=%s", err.Error())
+		return nil, err
+	}
+	defer tx.Rollback()
+	if len(e.readOnlySQL) > 0 {
+		if _, err := tx.ExecContext(ctx, e.readOnlySQL); err != nil {
+			l.Errorf("read only=%s", err.Error())
+			return nil, err
+		}
+	}
+
+	l.Infof("REQUEST: %s (query=%s, limit=%d)", query, q.Name, limit)
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &dbQueryResult{Query: q.Name, Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		if result.RowCount >= limit {
+			result.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+		result.RowCount++
+	}
+	if err := rows.Err(); err != nil {
+		l.Errorf("%s", err.Error())
+		return nil, err
+	}
+	result.Duration = time.Since(start).String()
+	l.Infof("%d row(s) returned by %s", result.RowCount, q.Name)
+	return result, nil
+}
+
+// dbQueryLimit returns ?limit= bounded by DB_QUERY_MAX_ROWS
+func dbQueryLimit(c *gin.Context) int {
+	maxRows, err := strconv.Atoi(getenvs.GetEnvString("DB_QUERY_MAX_ROWS", "1000"))
+	if err != nil || maxRows <= 0 {
+		maxRows = 1000
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 || limit > maxRows {
+		return maxRows
+	}
+	return limit
+}
+
+// dbQueryResponse runs the query ?name= and writes the result in JSON (or CSV with ?format=csv)
+func dbQueryResponse(c *gin.Context, db *sql.DB, e *dbEngine, l *logger) {
+	name := c.Query("name")
+	if len(name) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required", "queries": listDBNamedQueries()})
+		return
+	}
+	q, err := getDBNamedQuery(name, e)
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	result, err := dbRunReadOnlyQuery(db, e, q, c.Query, dbQueryLimit(c), l)
+	if err != nil {
+		if errors.Is(err, errDBQueryArgument) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+q.Name+`.csv"`)
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write(result.Columns)
+	for _, row := range result.Rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			if v != nil {
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		_ = w.Write(record)
+	}
+	w.Flush()
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/{engine}/query [get]
+// @summary Run a read-only query of the allow-list (DB_QUERIES_FILE)
+// @consume text/plain
+// @produce application/json,text/csv
+// @param engine path string true "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
+// @param name query string true "Query name"
+// @param limit query int false "Maximum number of rows (bounded by DB_QUERY_MAX_ROWS)"
+// @param format query string false "json (default) or csv"
+// @success 200 {object} dbQueryResult
+// @failure 400 string Bad request
+// @failure 404 string Not Found
+// @failure 500 string Internal Server Error
+func dbQueryHandler(c *gin.Context) {
+	engine := c.Param("engine")
+	e, err := getDBEngine(engine)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	l := requestLogger(c, strings.ToUpper(e.Name))
+	db, err := DBsqlconnect(engine, l)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+	dbQueryResponse(c, db, e, l)
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/target/{name}/query [get]
+// @summary Run a read-only query of the allow-list on a database target
+// @consume text/plain
+// @produce application/json,text/csv
+// @param name path string true "Target name (see DB_TARGETS)"
+// @param name query string true "Query name"
+// @param limit query int false "Maximum number of rows (bounded by DB_QUERY_MAX_ROWS)"
+// @param format query string false "json (default) or csv"
+// @success 200 {object} dbQueryResult
+// @failure 400 string Bad request
+// @failure 404 string Not Found
+// @failure 500 string Internal Server Error
+func dbTargetQueryHandler(c *gin.Context) {
+	t, err := getDBTarget(c.Param("name"))
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	dbQueryResponse(c, t.db, t.engine, requestLogger(c, "DB/"+strings.ToUpper(t.Name)))
+}
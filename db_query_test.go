@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDBNamedQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		params  []string
+		ids     []string
+		engines []string
+		err     string
+	}{
+		{name: "select", sql: "SELECT id FROM {table} WHERE status = ?", params: []string{"status"}, ids: []string{"table"}},
+		{name: "trailing semicolon", sql: "SELECT 1;"},
+		{name: "with", sql: "WITH t AS (SELECT 1 AS x) SELECT x FROM t"},
+		{name: "lower case", sql: "select id from orders where id = ?", params: []string{"id"}},
+		{name: "quoted question mark", sql: "SELECT id FROM orders WHERE note = '?' AND id = ?", params: []string{"id"}},
+		{name: "doubled quote", sql: "SELECT 'it''s ?' FROM orders WHERE id = ?", params: []string{"id"}},
+		{name: "quoted keyword", sql: "SELECT id FROM orders WHERE action = 'DELETE' AND \"update\" = 1"},
+		{name: "commented keyword", sql: "SELECT id -- no DELETE ? here\nFROM orders /* nor DROP ? */"},
+		{name: "column name with keyword", sql: "SELECT updated_at, created_by FROM orders"},
+		{name: "empty name", sql: "SELECT 1", err: "name is required"},
+		{name: "insert", sql: "INSERT INTO orders VALUES (1)", err: "only SELECT"},
+		{name: "two statements", sql: "SELECT 1; DROP TABLE orders", err: "only one statement"},
+		{name: "quoted semicolon", sql: "SELECT ';' FROM orders"},
+		{name: "with delete", sql: "WITH t AS (SELECT 1) DELETE FROM orders", err: "DELETE is not allowed"},
+		{name: "data-modifying cte", sql: "WITH d AS (DELETE FROM orders RETURNING id) SELECT * FROM d", err: "DELETE is not allowed"},
+		{name: "select into", sql: "SELECT * INTO backup FROM orders", err: "INTO is not allowed"},
+		{name: "for update", sql: "SELECT * FROM orders FOR UPDATE", err: "UPDATE is not allowed"},
+		{name: "exec", sql: "select 1 where exists (select 1) exec sp_who", err: "EXEC is not allowed"},
+		{name: "for share", sql: "SELECT * FROM orders FOR SHARE", err: "SHARE is not allowed"},
+		{name: "lock in share mode", sql: "SELECT * FROM orders LOCK IN SHARE MODE", err: "LOCK is not allowed"},
+		{name: "updlock hint", sql: "SELECT * FROM orders WITH (UPDLOCK, ROWLOCK)", err: "UPDLOCK is not allowed"},
+		{name: "commit", sql: "SELECT 1 COMMIT", err: "COMMIT is not allowed"},
+		{name: "backslash escape hides a keyword", sql: `SELECT 'a\'' DELETE FROM orders -- '`, err: "DELETE is not allowed"},
+		{name: "backslash escape hides a statement", sql: `SELECT 'a\''; DROP TABLE orders -- '`, err: "only one statement"},
+		{name: "backslash escape hides a placeholder", sql: `SELECT 'a\'' , ? -- '`, err: "number of ?"},
+		{name: "backslash without mysql", sql: `SELECT 'a\'' DELETE FROM orders -- '`, engines: []string{"postgres"}},
+		{name: "backslash with mariadb", sql: `SELECT 'a\'' DELETE FROM orders -- '`, engines: []string{"postgres", "mariadb"}, err: "DELETE is not allowed"},
+		{name: "escaped quote is ambiguous", sql: `SELECT 'it\'s' FROM orders WHERE id = ?`, params: []string{"id"}, engines: []string{"mysql"}, err: "number of ?"},
+		{name: "doubled quote with mysql", sql: `SELECT 'it''s' FROM orders WHERE id = ?`, params: []string{"id"}, engines: []string{"mysql"}},
+		{name: "missing param", sql: "SELECT id FROM orders WHERE id = ? AND status = ?", params: []string{"id"}, err: "number of ?"},
+		{name: "missing identifier", sql: "SELECT 1", ids: []string{"table"}, err: "identifier {table}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := test.name
+			if test.err == "name is required" {
+				name = ""
+			}
+			err := validateDBNamedQuery(&dbNamedQuery{Name: name, SQL: test.sql, Params: test.params, Identifiers: test.ids, Engines: test.engines})
+			if len(test.err) == 0 && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error %v, %q expected", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDBRebind(t *testing.T) {
+	tests := []struct {
+		engine string
+		query  string
+		want   string
+	}{
+		{"mysql", "SELECT ? FROM t WHERE a = ?", "SELECT ? FROM t WHERE a = ?"},
+		{"postgres", "SELECT ? FROM t WHERE a = ?", "SELECT $1 FROM t WHERE a = $2"},
+		{"sqlserver", "SELECT a FROM t WHERE a = ? AND b = ?", "SELECT a FROM t WHERE a = @p1 AND b = @p2"},
+		{"oracle", "SELECT a FROM t WHERE a = ?", "SELECT a FROM t WHERE a = :1"},
+		{"postgres", "SELECT '?' FROM t WHERE a = ?", "SELECT '?' FROM t WHERE a = $1"},
+		{"postgres", "SELECT 'it''s ?', \"c?\" FROM t WHERE a = ?", "SELECT 'it''s ?', \"c?\" FROM t WHERE a = $1"},
+		{"postgres", "SELECT a -- a = ?\nFROM t /* ? */ WHERE a = ?", "SELECT a -- a = ?\nFROM t /* ? */ WHERE a = $1"},
+		{"postgres", "SELECT a /*/ ? */ FROM t WHERE a = ?", "SELECT a /*/ ? */ FROM t WHERE a = $1"},
+		{"postgres", `SELECT 'a\' FROM t WHERE a = ?`, `SELECT 'a\' FROM t WHERE a = $1`},
+	}
+	for _, test := range tests {
+		e, err := getDBEngine(test.engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dbRebind(e, test.query); got != test.want {
+			t.Errorf("dbRebind(%s, %q) = %q, %q expected", test.engine, test.query, got, test.want)
+		}
+	}
+}
+
+// the allow-list refuses the writes, the read-only mode of sqlite is checked without the validation
+func TestDBRunReadOnlyQuerySqlite(t *testing.T) {
+	e, err := getDBEngine("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(e.Driver, "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// one connection: the connection of the query is reused by the next statements
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE orders (id INTEGER); INSERT INTO orders VALUES (1), (2)"); err != nil {
+		t.Fatal(err)
+	}
+	l := newLogger("TEST")
+	values := func(string) string { return "orders" }
+
+	count := &dbNamedQuery{Name: "count", SQL: "SELECT COUNT(*) FROM {table}", Identifiers: []string{"table"}}
+	result, err := dbRunReadOnlyQuery(db, e, count, values, 10, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RowCount != 1 || result.Rows[0][0] != int64(2) {
+		t.Fatalf("unexpected result %v", result.Rows)
+	}
+
+	for _, query := range []string{"DELETE FROM {table}", "WITH t AS (SELECT 1) DELETE FROM {table}"} {
+		write := &dbNamedQuery{Name: "write", SQL: query, Identifiers: []string{"table"}}
+		if _, err := dbRunReadOnlyQuery(db, e, write, values, 10, l); err == nil {
+			t.Fatalf("%s: the write is not refused", query)
+		}
+	}
+
+	// the connection is writable again after the query
+	if _, err := db.ExecContext(context.Background(), "INSERT INTO orders VALUES (3)"); err != nil {
+		t.Fatalf("connection left read-only: %v", err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM orders").Scan(&n); err != nil || n != 3 {
+		t.Fatalf("%d rows (%v), 3 expected", n, err)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- Database schema introspection
+
+// dbCatalog contains the queries of the information_schema/catalog of an engine
+//   - the first parameter is always the schema ("" for the current schema)
+//   - the second parameter is the table (columns and indexes)
+type dbCatalog struct {
+	Schemas string
+	Tables  string // name, type, approximate rows
+	Columns string // name, type, nullable (YES/NO), default
+	Indexes string // name, columns (comma separated), unique
+}
+
+type dbSchemaTable struct {
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	ApproximateRows *int64 `json:"approximate_rows"`
+}
+
+type dbSchemaColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	Default  string `json:"default,omitempty"`
+}
+
+type dbSchemaIndex struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+}
+
+var mysqlCatalog = &dbCatalog{
+	Schemas: `SELECT schema_name FROM information_schema.schemata ORDER BY 1`,
+	Tables: `SELECT table_name, table_type, table_rows FROM information_schema.tables
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) ORDER BY 1`,
+	Columns: `SELECT column_name, column_type, is_nullable, column_default FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ? ORDER BY ordinal_position`,
+	Indexes: `SELECT index_name, GROUP_CONCAT(column_name ORDER BY seq_in_index), MAX(non_unique) = 0 FROM information_schema.statistics
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ? GROUP BY index_name ORDER BY 1`,
+}
+
+var postgresCatalog = &dbCatalog{
+	Schemas: `SELECT schema_name FROM information_schema.schemata ORDER BY 1`,
+	Tables: `SELECT c.relname,
+			CASE c.relkind WHEN 'r' THEN 'BASE TABLE' WHEN 'v' THEN 'VIEW' WHEN 'm' THEN 'MATERIALIZED VIEW' ELSE 'PARTITIONED TABLE' END,
+			CASE WHEN c.relkind IN ('r', 'm') AND c.reltuples >= 0 THEN c.reltuples::bigint END
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = COALESCE(NULLIF(?, ''), current_schema()) AND c.relkind IN ('r', 'v', 'm', 'p') ORDER BY 1`,
+	Columns: `SELECT column_name, data_type, is_nullable, column_default FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF(?, ''), current_schema()) AND table_name = ? ORDER BY ordinal_position`,
+	Indexes: `SELECT i.relname, string_agg(a.attname, ',' ORDER BY array_position(ix.indkey::int2[], a.attnum)), ix.indisunique
+		FROM pg_index ix
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = ANY(ix.indkey)
+		WHERE n.nspname = COALESCE(NULLIF(?, ''), current_schema()) AND t.relname = ?
+		GROUP BY i.relname, ix.indisunique ORDER BY 1`,
+}
+
+var sqlserverCatalog = &dbCatalog{
+	Schemas: `SELECT name FROM sys.schemas ORDER BY name`,
+	Tables: `SELECT o.name, o.type_desc, SUM(p.rows)
+		FROM sys.objects o
+		JOIN sys.schemas s ON s.schema_id = o.schema_id
+		LEFT JOIN sys.partitions p ON p.object_id = o.object_id AND p.index_id IN (0, 1)
+		WHERE o.type IN ('U', 'V') AND s.name = COALESCE(NULLIF(?, ''), SCHEMA_NAME())
+		GROUP BY o.name, o.type_desc ORDER BY o.name`,
+	Columns: `SELECT column_name, data_type, is_nullable, column_default FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF(?, ''), SCHEMA_NAME()) AND table_name = ? ORDER BY ordinal_position`,
+	Indexes: `SELECT i.name, STRING_AGG(c.name, ',') WITHIN GROUP (ORDER BY ic.key_ordinal), i.is_unique
+		FROM sys.indexes i
+		JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+		JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+		JOIN sys.tables t ON t.object_id = i.object_id
+		JOIN sys.schemas s ON s.schema_id = t.schema_id
+		WHERE s.name = COALESCE(NULLIF(?, ''), SCHEMA_NAME()) AND t.name = ? AND i.name IS NOT NULL
+		GROUP BY i.name, i.is_unique ORDER BY i.name`,
+}
+
+// with oracle, an empty string is NULL and the schema is the owner
+var oracleCatalog = &dbCatalog{
+	Schemas: `SELECT username FROM all_users ORDER BY username`,
+	Tables: `WITH s AS (SELECT COALESCE(?, USER) AS owner FROM dual)
+		SELECT t.table_name, 'BASE TABLE', t.num_rows FROM all_tables t CROSS JOIN s WHERE t.owner = s.owner
+		UNION ALL
+		SELECT v.view_name, 'VIEW', NULL FROM all_views v CROSS JOIN s WHERE v.owner = s.owner
+		ORDER BY 1`,
+	Columns: `WITH s AS (SELECT COALESCE(?, USER) AS owner FROM dual)
+		SELECT c.column_name, c.data_type, CASE c.nullable WHEN 'Y' THEN 'YES' ELSE 'NO' END, NULL
+		FROM all_tab_columns c CROSS JOIN s WHERE c.owner = s.owner AND c.table_name = ? ORDER BY c.column_id`,
+	Indexes: `WITH s AS (SELECT COALESCE(?, USER) AS owner FROM dual)
+		SELECT i.index_name, LISTAGG(c.column_name, ',') WITHIN GROUP (ORDER BY c.column_position), CASE i.uniqueness WHEN 'UNIQUE' THEN 1 ELSE 0 END
+		FROM all_indexes i
+		JOIN all_ind_columns c ON c.index_owner = i.owner AND c.index_name = i.index_name
+		CROSS JOIN s
+		WHERE i.table_owner = s.owner AND i.table_name = ?
+		GROUP BY i.index_name, i.uniqueness ORDER BY 1`,
+}
+
+// with sqlite, the schemas are the attached databases (main, temp ...)
+var sqliteCatalog = &dbCatalog{
+	Schemas: `SELECT name FROM pragma_database_list ORDER BY seq`,
+	Tables: `SELECT name, CASE type WHEN 'table' THEN 'BASE TABLE' ELSE upper(type) END, NULL FROM pragma_table_list
+		WHERE schema = COALESCE(NULLIF(?, ''), 'main') AND name NOT LIKE 'sqlite_%' ORDER BY 1`,
+	Columns: `SELECT name, type, CASE "notnull" WHEN 0 THEN 'YES' ELSE 'NO' END, dflt_value FROM pragma_table_info
+		WHERE schema = COALESCE(NULLIF(?, ''), 'main') AND arg = ? ORDER BY cid`,
+	Indexes: `SELECT il.name, (SELECT group_concat(ii.name, ',') FROM pragma_index_info(il.name, il.schema) ii), il."unique" FROM pragma_index_list il
+		WHERE il.schema = COALESCE(NULLIF(?, ''), 'main') AND il.arg = ? ORDER BY 1`,
+}
+
+var errDBNoCatalog = errors.New("schema introspection is not available")
+
+// dbSchemaQuery runs a catalog query with the DB_QUERY_TIMEOUT and calls scan for each row
+func dbSchemaQuery(db *sql.DB, e *dbEngine, query string, l *logger, scan func(*sql.Rows) error, args ...interface{}) error {
+	timeout, err := time.ParseDuration(getenvs.GetEnvString("DB_QUERY_TIMEOUT", "10s"))
+	if err != nil {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, dbRebind(e, query), args...)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			l.Errorf("%s", err.Error())
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// dbBool converts the unique flags of the catalogs (bool, 0/1, "t"/"f" ...)
+func dbBool(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case int64:
+		return b != 0
+	case []byte:
+		return dbBool(string(b))
+	case string:
+		b = strings.ToLower(b)
+		return b == "1" || b == "t" || b == "true" || b == "y" || b == "yes"
+	}
+	return false
+}
+
+func dbListSchemas(db *sql.DB, e *dbEngine, l *logger) ([]string, error) {
+	schemas := []string{}
+	err := dbSchemaQuery(db, e, e.catalog.Schemas, l, func(rows *sql.Rows) error {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		schemas = append(schemas, name)
+		return nil
+	})
+	return schemas, err
+}
+
+func dbListTables(db *sql.DB, e *dbEngine, schema string, l *logger) ([]dbSchemaTable, error) {
+	tables := []dbSchemaTable{}
+	err := dbSchemaQuery(db, e, e.catalog.Tables, l, func(rows *sql.Rows) error {
+		var t dbSchemaTable
+		var approximateRows sql.NullInt64
+		if err := rows.Scan(&t.Name, &t.Type, &approximateRows); err != nil {
+			return err
+		}
+		if approximateRows.Valid {
+			t.ApproximateRows = &approximateRows.Int64
+		}
+		tables = append(tables, t)
+		return nil
+	}, schema)
+	return tables, err
+}
+
+func dbListColumns(db *sql.DB, e *dbEngine, schema string, table string, l *logger) ([]dbSchemaColumn, error) {
+	columns := []dbSchemaColumn{}
+	err := dbSchemaQuery(db, e, e.catalog.Columns, l, func(rows *sql.Rows) error {
+		var c dbSchemaColumn
+		var nullable string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&c.Name, &c.Type, &nullable, &defaultValue); err != nil {
+			return err
+		}
+		c.Nullable = dbBool(nullable)
+		c.Default = defaultValue.String
+		columns = append(columns, c)
+		return nil
+	}, schema, table)
+	return columns, err
+}
+
+func dbListIndexes(db *sql.DB, e *dbEngine, schema string, table string, l *logger) ([]dbSchemaIndex, error) {
+	indexes := []dbSchemaIndex{}
+	err := dbSchemaQuery(db, e, e.catalog.Indexes, l, func(rows *sql.Rows) error {
+		var i dbSchemaIndex
+		var columns sql.NullString
+		var unique interface{}
+		if err := rows.Scan(&i.Name, &columns, &unique); err != nil {
+			return err
+		}
+		i.Columns = strings.Split(columns.String, ",")
+		i.Unique = dbBool(unique)
+		indexes = append(indexes, i)
+		return nil
+	}, schema, table)
+	return indexes, err
+}
+
+// dbFromContext returns the database of the :name target or of the :engine,
+// release must be called when the database is no longer used
+func dbFromContext(c *gin.Context) (db *sql.DB, e *dbEngine, l *logger, release func(), status int, err error) {
+	if name := c.Param("name"); len(name) > 0 {
+		t, err := getDBTarget(name)
+		if err != nil {
+			return nil, nil, nil, nil, http.StatusNotFound, err
+		}
+		return t.db, t.engine, requestLogger(c, "DB/"+strings.ToUpper(t.Name)), func() {}, http.StatusOK, nil
+	}
+	e, err = getDBEngine(c.Param("engine"))
+	if err != nil {
+		return nil, nil, nil, nil, http.StatusBadRequest, err
+	}
+	l = requestLogger(c, strings.ToUpper(e.Name))
+	db, err = DBsqlconnect(e.Name, l)
+	if err != nil {
+		return nil, nil, nil, nil, http.StatusInternalServerError, err
+	}
+	return db, e, l, func() { db.Close() }, http.StatusOK, nil
+}
+
+// dbSchemaResponse writes in JSON the result of list for the database of the request
+func dbSchemaResponse(c *gin.Context, list func(db *sql.DB, e *dbEngine, l *logger) (interface{}, error)) {
+	db, e, l, release, status, err := dbFromContext(c)
+	if err != nil {
+		c.String(status, err.Error())
+		return
+	}
+	defer release()
+	if e.catalog == nil {
+		c.String(http.StatusNotImplemented, errDBNoCatalog.Error()+" for "+e.Name)
+		return
+	}
+	result, err := list(db, e, l)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/{engine}/schemas [get]
+// @router /v1/db/target/{name}/schemas [get]
+// @summary List the schemas
+// @produce application/json
+// @param engine path string false "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
+// @param name path string false "Target name (see DB_TARGETS)"
+// @success 200 {array} string
+// @failure 500 string Internal Server Error
+func dbSchemasHandler(c *gin.Context) {
+	dbSchemaResponse(c, func(db *sql.DB, e *dbEngine, l *logger) (interface{}, error) {
+		return dbListSchemas(db, e, l)
+	})
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/{engine}/tables [get]
+// @router /v1/db/target/{name}/tables [get]
+// @summary List the tables and views with their approximate number of rows
+// @produce application/json
+// @param engine path string false "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
+// @param name path string false "Target name (see DB_TARGETS)"
+// @param schema query string false "Schema (current schema by default)"
+// @success 200 {array} dbSchemaTable
+// @failure 500 string Internal Server Error
+func dbTablesHandler(c *gin.Context) {
+	dbSchemaResponse(c, func(db *sql.DB, e *dbEngine, l *logger) (interface{}, error) {
+		return dbListTables(db, e, c.Query("schema"), l)
+	})
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/{engine}/tables/{table}/columns [get]
+// @router /v1/db/target/{name}/tables/{table}/columns [get]
+// @summary List the columns of a table with their types
+// @produce application/json
+// @param engine path string false "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
+// @param name path string false "Target name (see DB_TARGETS)"
+// @param table path string true "Table name"
+// @param schema query string false "Schema (current schema by default)"
+// @success 200 {array} dbSchemaColumn
+// @failure 500 string Internal Server Error
+func dbColumnsHandler(c *gin.Context) {
+	dbSchemaResponse(c, func(db *sql.DB, e *dbEngine, l *logger) (interface{}, error) {
+		return dbListColumns(db, e, c.Query("schema"), c.Param("table"), l)
+	})
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/{engine}/tables/{table}/indexes [get]
+// @router /v1/db/target/{name}/tables/{table}/indexes [get]
+// @summary List the indexes of a table
+// @produce application/json
+// @param engine path string false "Database Engine (ex: mysql, postgres, sqlserver, oracle, sqlite...)"
+// @param name path string false "Target name (see DB_TARGETS)"
+// @param table path string true "Table name"
+// @param schema query string false "Schema (current schema by default)"
+// @success 200 {array} dbSchemaIndex
+// @failure 500 string Internal Server Error
+func dbIndexesHandler(c *gin.Context) {
+	dbSchemaResponse(c, func(db *sql.DB, e *dbEngine, l *logger) (interface{}, error) {
+		return dbListIndexes(db, e, c.Query("schema"), c.Param("table"), l)
+	})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- Database targets
+
+// errDBUnknownTarget is returned when the :name is not declared
+var errDBUnknownTarget = errors.New("unknown database target")
+
+// dbTargetConfig is one entry of DB_TARGETS_FILE
+type dbTargetConfig struct {
+	Name            string `json:"name"`
+	Engine          string `json:"engine"`
+	User            string `json:"user"`
+	Password        string `json:"password"`
+	Host            string `json:"host"`
+	Port            string `json:"port"`
+	Database        string `json:"database"`
+	Timeout         string `json:"timeout"`
+	MaxOpenConns    int    `json:"max_open_conns"`
+	MaxIdleConns    int    `json:"max_idle_conns"`
+	ConnMaxLifetime string `json:"conn_max_lifetime"`
+	TLSMode         string `json:"tls_mode"`
+	TLSCA           string `json:"tls_ca"`
+	TLSCert         string `json:"tls_cert"`
+	TLSKey          string `json:"tls_key"`
+	TLSServerName   string `json:"tls_server_name"`
+}
+
+// dbTarget is a named database with its own connection pool
+type dbTarget struct {
+	Name   string
+	engine *dbEngine
+	cfg    dbConfig
+	db     *sql.DB
+}
+
+type dbTargetInfo struct {
+	Name     string      `json:"name"`
+	Engine   string      `json:"engine"`
+	Host     string      `json:"host"`
+	Port     string      `json:"port"`
+	Database string      `json:"database"`
+	TLSMode  string      `json:"tls_mode"`
+	Stats    dbPoolStats `json:"stats"`
+}
+
+type dbPoolStats struct {
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDuration       string `json:"wait_duration"`
+	MaxIdleClosed      int64  `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+}
+
+var (
+	dbTargets     = map[string]*dbTarget{}
+	dbTargetsOnce sync.Once
+)
+
+// initDBTargets opens the pools of DB_TARGETS and DB_TARGETS_FILE (only once)
+func initDBTargets() {
+	dbTargetsOnce.Do(func() {
+		l := newLogger("DB/TARGETS")
+		var configs []dbTargetConfig
+
+		// DB_TARGETS=orders:postgres,users:mysql, parameters in DB_ORDERS_USER, DB_ORDERS_HOST ...
+		for _, item := range strings.Split(os.Getenv("DB_TARGETS"), ",") {
+			item = strings.TrimSpace(item)
+			if len(item) == 0 {
+				continue
+			}
+			parts := strings.SplitN(item, ":", 2)
+			if len(parts) != 2 {
+				l.Errorf("invalid target %s (format name:engine)", item)
+				continue
+			}
+			configs = append(configs, dbTargetConfig{Name: parts[0], Engine: parts[1]})
+		}
+
+		// DB_TARGETS_FILE=/path/targets.json
+		if file := os.Getenv("DB_TARGETS_FILE"); len(file) > 0 {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				l.Errorf("%s", err.Error())
+			} else {
+				var fileConfigs []dbTargetConfig
+				if err := json.Unmarshal(content, &fileConfigs); err != nil {
+					l.Errorf("%s : %s", file, err.Error())
+				}
+				configs = append(configs, fileConfigs...)
+			}
+		}
+
+		for _, tc := range configs {
+			t, err := newDBTarget(tc, l)
+			if err != nil {
+				l.Errorf("%s : %s", tc.Name, err.Error())
+				continue
+			}
+			dbTargets[t.Name] = t
+			l.Infof("target %s (%s) declared", t.Name, t.engine.Name)
+		}
+	})
+}
+
+func newDBTarget(tc dbTargetConfig, l *logger) (*dbTarget, error) {
+	name := strings.ToLower(strings.TrimSpace(tc.Name))
+	if len(name) == 0 {
+		return nil, errors.New("name is required")
+	}
+	if _, exists := dbTargets[name]; exists {
+		return nil, errors.New("target already declared")
+	}
+	e, err := getDBEngine(tc.Engine)
+	if err != nil {
+		return nil, err
+	}
+
+	// parameters in DB_<NAME>_*, overridden by the file
+	prefix := "DB_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	cfg := dbConfigFromEnv(e, prefix)
+	override := func(value *string, fileValue string) {
+		if len(fileValue) > 0 {
+			*value = fileValue
+		}
+	}
+	override(&cfg.User, tc.User)
+	override(&cfg.Password, tc.Password)
+	override(&cfg.Host, tc.Host)
+	override(&cfg.Port, tc.Port)
+	override(&cfg.Name, tc.Database)
+	override(&cfg.Timeout, tc.Timeout)
+	override(&cfg.TLS.Mode, strings.ToLower(tc.TLSMode))
+	override(&cfg.TLS.CA, tc.TLSCA)
+	override(&cfg.TLS.Cert, tc.TLSCert)
+	override(&cfg.TLS.Key, tc.TLSKey)
+	override(&cfg.TLS.ServerName, tc.TLSServerName)
+
+	db, err := dbOpen(e, cfg, newLogger("DB/"+strings.ToUpper(name)))
+	if err != nil {
+		return nil, err
+	}
+
+	// pool settings
+	maxOpen := tc.MaxOpenConns
+	if maxOpen == 0 {
+		maxOpen, _ = strconv.Atoi(getenvs.GetEnvString(prefix+"MAX_OPEN_CONNS", getenvs.GetEnvString("DB_MAX_OPEN_CONNS", "5")))
+	}
+	maxIdle := tc.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle, _ = strconv.Atoi(getenvs.GetEnvString(prefix+"MAX_IDLE_CONNS", getenvs.GetEnvString("DB_MAX_IDLE_CONNS", "2")))
+	}
+	lifetime := tc.ConnMaxLifetime
+	if len(lifetime) == 0 {
+		lifetime = getenvs.GetEnvString(prefix+"CONN_MAX_LIFETIME", getenvs.GetEnvString("DB_CONN_MAX_LIFETIME", "5m"))
+	}
+	plifetime, err := time.ParseDuration(lifetime)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("conn_max_lifetime: %s", err.Error())
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(plifetime)
+
+	// pool stats in /v1/metrics (go_sql_* with db_name=<name>)
+	if err := prometheus.Register(collectors.NewDBStatsCollector(db, name)); err != nil {
+		l.Errorf("metrics : %s", err.Error())
+	}
+
+	return &dbTarget{Name: name, engine: e, cfg: cfg, db: db}, nil
+}
+
+func getDBTarget(name string) (*dbTarget, error) {
+	initDBTargets()
+	t, ok := dbTargets[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errDBUnknownTarget, name)
+	}
+	return t, nil
+}
+
+func (t *dbTarget) info() dbTargetInfo {
+	stats := t.db.Stats()
+	return dbTargetInfo{
+		Name:     t.Name,
+		Engine:   t.engine.Name,
+		Host:     t.cfg.Host,
+		Port:     t.cfg.Port,
+		Database: t.cfg.Name,
+		TLSMode:  t.cfg.TLS.Mode,
+		Stats: dbPoolStats{
+			MaxOpenConnections: stats.MaxOpenConnections,
+			OpenConnections:    stats.OpenConnections,
+			InUse:              stats.InUse,
+			Idle:               stats.Idle,
+			WaitCount:          stats.WaitCount,
+			WaitDuration:       stats.WaitDuration.String(),
+			MaxIdleClosed:      stats.MaxIdleClosed,
+			MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+		},
+	}
+}
+
+// version checks the connection and returns the version of the database
+func (t *dbTarget) version(l *logger) (string, error) {
+	if err := t.db.Ping(); err != nil {
+		l.Errorf("ping=%s", err.Error())
+		return "", err
+	}
+	return dbQueryVersion(t.db, t.engine, l)
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/target [get]
+// @summary List the database targets and the stats of their pool
+// @produce application/json
+// @success 200 {array} dbTargetInfo
+func dbTargetListHandler(c *gin.Context) {
+	initDBTargets()
+	infos := make([]dbTargetInfo, 0, len(dbTargets))
+	for _, t := range dbTargets {
+		infos = append(infos, t.info())
+	}
+	sort.Slice(infos, func(i, k int) bool { return infos[i].Name < infos[k].Name })
+	c.JSON(http.StatusOK, infos)
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/target/{name} [get]
+// @summary Test the connection of a database target
+// @consume text/plain
+// @produce text/plain
+// @param name path string true "Target name (see DB_TARGETS)"
+// @param format query string false "text (default) or json"
+// @success 200 string OK
+// @failure 404 string Not Found
+// @failure 500 string Internal Server Error
+func dbTargetHandler(c *gin.Context) {
+	t, err := getDBTarget(c.Param("name"))
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	version, err := t.version(requestLogger(c, "DB/"+strings.ToUpper(t.Name)))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	dbConnectionResponse(c, t.Name, t.db, t.engine, t.cfg, version)
+}
+
+// ---- swagger Informations
+// @Tags         Database
+// @router /v1/db/target/{name}/count/{table} [get]
+// @summary Count lines in tables of a database target
+// @consume text/plain
+// @produce text/plain
+// @param name path string true "Target name (see DB_TARGETS)"
+// @param table path string true "Table name"
+// @success 200 string OK
+// @failure 404 string Not Found
+// @failure 500 string Internal Server Error
+func dbTargetCountRowTableHandler(c *gin.Context) {
+	t, err := getDBTarget(c.Param("name"))
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	table := c.Param("table")
+	count, err := dbCountRows(t.db, table, requestLogger(c, "DB/"+strings.ToUpper(t.Name)))
+	if err != nil {
+		if errors.Is(err, errDBQueryArgument) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.String(http.StatusOK, strconv.Itoa(count)+" row(s) found in table "+strings.ToUpper(table))
+}
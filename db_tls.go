@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------- Database TLS
+
+// TLS modes, same names as the sslmode of postgres
+const (
+	dbTLSDisable    = "disable"
+	dbTLSRequire    = "require"
+	dbTLSVerifyCA   = "verify-ca"
+	dbTLSVerifyFull = "verify-full"
+)
+
+var errDBTLSNotSupported = errors.New("TLS option not supported")
+
+// dbTLSConfig contains the TLS parameters (DB_TLS_* variables)
+type dbTLSConfig struct {
+	Mode       string // disable, require, verify-ca, verify-full
+	CA         string // PEM bundle of CA certificates
+	Cert       string // client certificate (mTLS)
+	Key        string // client key (mTLS)
+	ServerName string // name in the server certificate (DB_HOST by default)
+}
+
+// registrationKey is the name of the TLS config registered in the mysql driver, the targets with the same
+// host and port and a different TLS config do not overwrite each other
+func (t dbTLSConfig) registrationKey(host, port string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{host, port, t.Mode, t.CA, t.Cert, t.Key, t.ServerName}, "\x00")))
+	return "macgover-" + hex.EncodeToString(sum[:8])
+}
+
+func (t dbTLSConfig) enabled() bool {
+	return len(t.Mode) > 0 && t.Mode != dbTLSDisable
+}
+
+func (t dbTLSConfig) validate() error {
+	switch t.Mode {
+	case "", dbTLSDisable, dbTLSRequire, dbTLSVerifyCA, dbTLSVerifyFull:
+	default:
+		return fmt.Errorf("%w: mode %s (disable, require, verify-ca or verify-full)", errDBTLSNotSupported, t.Mode)
+	}
+	if (len(t.Cert) > 0) != (len(t.Key) > 0) {
+		return errors.New("TLS client certificate and key must be set together")
+	}
+	return nil
+}
+
+// tlsConfig returns the crypto/tls configuration of the mode (nil when disabled)
+func (t dbTLSConfig) tlsConfig(host string) (*tls.Config, error) {
+	if !t.enabled() {
+		return nil, nil
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host}
+	if len(t.ServerName) > 0 {
+		config.ServerName = t.ServerName
+	}
+	if len(t.CA) > 0 {
+		pool, err := loadCertPool(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(t.Cert) > 0 {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	switch t.Mode {
+	case dbTLSRequire:
+		config.InsecureSkipVerify = true
+	case dbTLSVerifyCA:
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChainOnly(config.RootCAs)
+	}
+	return config, nil
+}
+
+// dbTLSReport is the TLS of the session opened by the driver, with the certificates of the server
+// read in a separate handshake (the drivers do not expose their TLS connection)
+type dbTLSReport struct {
+	Encrypted   bool     `json:"encrypted"`
+	Version     string   `json:"version,omitempty"`
+	CipherSuite string   `json:"cipher_suite,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Server      *tlsInfo `json:"server,omitempty"`
+}
+
+// dbSessionTLS reads the TLS of the session in the database (nil when not available)
+type dbSessionTLS func(ctx context.Context, db *sql.DB) (encrypted bool, version string, cipher string, err error)
+
+// newDBTLSReport asks the database if the session of the pool is encrypted, it is an error when the
+// session does not match the TLS mode (nil for the engines without network)
+func newDBTLSReport(db *sql.DB, e *dbEngine, cfg dbConfig) *dbTLSReport {
+	if e.sessionTLS == nil {
+		return nil
+	}
+	timeout, err := strconv.Atoi(cfg.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 5
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	report := &dbTLSReport{}
+	encrypted, version, cipher, err := e.sessionTLS(ctx, db)
+	switch {
+	case err != nil:
+		report.Error = "session not readable: " + err.Error()
+	case cfg.TLS.enabled() && !encrypted:
+		report.Error = "the session of the driver is not encrypted (tls mode " + cfg.TLS.Mode + ")"
+	default:
+		report.Encrypted, report.Version, report.CipherSuite = encrypted, version, cipher
+	}
+	if cfg.TLS.enabled() {
+		report.Server = dbTLSProbe(e, cfg)
+	}
+	return report
+}
+
+// String displays the report in text format
+func (r *dbTLSReport) String() string {
+	line := "TLS: not encrypted"
+	if r.Encrypted {
+		line = strings.TrimSpace("TLS: encrypted " + r.Version + " " + r.CipherSuite)
+	}
+	if len(r.Error) > 0 {
+		line = "TLS: " + r.Error
+	}
+	if r.Server == nil {
+		return line
+	}
+	return line + "\nServer " + r.Server.String()
+}
+
+// postgresSessionTLS reads pg_stat_ssl (postgres 9.5+)
+func postgresSessionTLS(ctx context.Context, db *sql.DB) (bool, string, string, error) {
+	var encrypted bool
+	var version, cipher string
+	err := db.QueryRowContext(ctx, "SELECT ssl, COALESCE(version, ''), COALESCE(cipher, '') FROM pg_stat_ssl WHERE pid = pg_backend_pid()").Scan(&encrypted, &version, &cipher)
+	return encrypted, version, cipher, err
+}
+
+// mysqlSessionTLS reads the status Ssl_version and Ssl_cipher of the session
+func mysqlSessionTLS(ctx context.Context, db *sql.DB) (bool, string, string, error) {
+	rows, err := db.QueryContext(ctx, "SHOW SESSION STATUS WHERE Variable_name IN ('Ssl_version', 'Ssl_cipher')")
+	if err != nil {
+		return false, "", "", err
+	}
+	defer rows.Close()
+	status := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return false, "", "", err
+		}
+		status[name] = value
+	}
+	return len(status["Ssl_cipher"]) > 0, status["Ssl_version"], status["Ssl_cipher"], rows.Err()
+}
+
+// sqlserverSessionTLS reads sys.dm_exec_connections (permission VIEW SERVER STATE)
+func sqlserverSessionTLS(ctx context.Context, db *sql.DB) (bool, string, string, error) {
+	var encrypt string
+	err := db.QueryRowContext(ctx, "SELECT encrypt_option FROM sys.dm_exec_connections WHERE session_id = @@SPID").Scan(&encrypt)
+	return strings.EqualFold(encrypt, "TRUE"), "", "", err
+}
+
+// oracleSessionTLS reads the network protocol of the session (tcps with TLS)
+func oracleSessionTLS(ctx context.Context, db *sql.DB) (bool, string, string, error) {
+	var protocol string
+	err := db.QueryRowContext(ctx, "SELECT SYS_CONTEXT('USERENV', 'NETWORK_PROTOCOL') FROM DUAL").Scan(&protocol)
+	return strings.EqualFold(protocol, "tcps"), "", "", err
+}
+
+// dbTLSProbe negotiates TLS with the database server like the driver does and
+// returns the TLS version, the cipher and the certificates of the server
+func dbTLSProbe(e *dbEngine, cfg dbConfig) *tlsInfo {
+	if !cfg.TLS.enabled() {
+		return &tlsInfo{Error: "disabled"}
+	}
+	if e.startTLS == nil {
+		return &tlsInfo{Error: "certificates not available for " + e.Name}
+	}
+	config, err := cfg.TLS.tlsConfig(cfg.Host)
+	if err != nil {
+		return &tlsInfo{Error: err.Error()}
+	}
+	timeout, _ := strconv.Atoi(cfg.Timeout)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(cfg.Host, cfg.Port), time.Until(deadline))
+	if err != nil {
+		return &tlsInfo{Error: err.Error()}
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+
+	if err := e.startTLS(conn); err != nil {
+		return &tlsInfo{Error: err.Error()}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return &tlsInfo{Error: err.Error()}
+	}
+	return newTLSInfo(tlsConn.ConnectionState())
+}
+
+// postgresStartTLS sends the SSLRequest message
+func postgresStartTLS(conn net.Conn) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], 80877103)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if response[0] != 'S' {
+		return errors.New("the server does not support TLS")
+	}
+	return nil
+}
+
+// mysqlStartTLS reads the handshake of the server and sends the SSLRequest packet
+func mysqlStartTLS(conn net.Conn) error {
+	const (
+		clientLongPassword     = 0x00000001
+		clientProtocol41       = 0x00000200
+		clientSSL              = 0x00000800
+		clientSecureConnection = 0x00008000
+	)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	greeting := make([]byte, length)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return err
+	}
+	if len(greeting) > 0 && greeting[0] == 0xff {
+		return errors.New("the server refused the connection")
+	}
+	// protocol version, server version (NUL terminated), connection id, auth data, filler, capabilities
+	end := 1
+	for end < len(greeting) && greeting[end] != 0 {
+		end++
+	}
+	pos := end + 1 + 4 + 8 + 1
+	if pos+2 > len(greeting) {
+		return errors.New("invalid handshake packet")
+	}
+	if binary.LittleEndian.Uint16(greeting[pos:pos+2])&clientSSL == 0 {
+		return errors.New("the server does not support TLS")
+	}
+
+	packet := make([]byte, 4+32)
+	packet[0] = 32
+	packet[3] = 1 // sequence
+	binary.LittleEndian.PutUint32(packet[4:8], clientLongPassword|clientProtocol41|clientSSL|clientSecureConnection)
+	binary.LittleEndian.PutUint32(packet[8:12], 1<<24)
+	packet[12] = 45 // utf8mb4_general_ci
+	_, err := conn.Write(packet)
+	return err
+}
+
+// oracleStartTLS does nothing, TCPS starts with the TLS handshake
+func oracleStartTLS(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --------------------------- Echo of the request
+
+// echoResponse is the request received by /v1/echo
+type echoResponse struct {
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	Query        map[string][]string `json:"query"`
+	Headers      map[string][]string `json:"headers"`
+	Body         interface{}         `json:"body,omitempty"`
+	BodyEncoding string              `json:"body_encoding,omitempty"` // json, form, text or base64
+	BodySize     int                 `json:"body_size"`
+	Host         string              `json:"host"`
+	Protocol     string              `json:"protocol"`
+	RemoteAddr   string              `json:"remote_addr"`
+	ClientIP     string              `json:"client_ip"`
+	TLS          *tlsInfo            `json:"tls,omitempty"`
+	Forwarded    *echoForwarded      `json:"forwarded,omitempty"`
+}
+
+// echoForwarded is the chain of the proxies (X-Forwarded-*, Forwarded, X-Real-IP)
+type echoForwarded struct {
+	For       []string `json:"for,omitempty"` // X-Forwarded-For, the client first
+	Proto     string   `json:"proto,omitempty"`
+	Host      string   `json:"host,omitempty"`
+	Port      string   `json:"port,omitempty"`
+	Prefix    string   `json:"prefix,omitempty"`
+	RealIP    string   `json:"real_ip,omitempty"`
+	Forwarded []string `json:"forwarded,omitempty"` // RFC 7239
+}
+
+// echoBody returns the body decoded : JSON document, form, UTF-8 text or base64 for the binary content
+func echoBody(body []byte, contentType string) (interface{}, string) {
+	if len(body) == 0 {
+		return nil, ""
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body), "json"
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") && utf8.Valid(body) {
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			return values, "form"
+		}
+	}
+	text := string(body)
+	if utf8.ValidString(text) && strings.IndexFunc(text, func(r rune) bool { return unicode.IsControl(r) && !unicode.IsSpace(r) }) < 0 {
+		return text, "text"
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// echoForwardedChain returns the headers added by the proxies (nil without proxy)
+func echoForwardedChain(header http.Header) *echoForwarded {
+	forwarded := &echoForwarded{
+		Proto:     header.Get("X-Forwarded-Proto"),
+		Host:      header.Get("X-Forwarded-Host"),
+		Port:      header.Get("X-Forwarded-Port"),
+		Prefix:    header.Get("X-Forwarded-Prefix"),
+		RealIP:    header.Get("X-Real-Ip"),
+		Forwarded: header.Values("Forwarded"),
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(value, ",") {
+			if ip = strings.TrimSpace(ip); len(ip) > 0 {
+				forwarded.For = append(forwarded.For, ip)
+			}
+		}
+	}
+	if len(forwarded.For) == 0 && len(forwarded.Proto) == 0 && len(forwarded.Host) == 0 && len(forwarded.Port) == 0 &&
+		len(forwarded.Prefix) == 0 && len(forwarded.RealIP) == 0 && len(forwarded.Forwarded) == 0 {
+		return nil
+	}
+	return forwarded
+}
+
+// ---- swagger Informations
+// @Tags         Debugging
+// @router /v1/echo [get]
+// @router /v1/echo [post]
+// @router /v1/echo [put]
+// @router /v1/echo [patch]
+// @router /v1/echo [delete]
+// @router /v1/echo [options]
+// @router /v1/echo/{path} [get]
+// @router /v1/echo/{path} [post]
+// @router /v1/echo/{path} [put]
+// @router /v1/echo/{path} [patch]
+// @router /v1/echo/{path} [delete]
+// @router /v1/echo/{path} [options]
+// @summary Return the request in JSON (method, path, query, headers, body, remote address, TLS, X-Forwarded-* chain)
+// @param path path string false "any sub-path"
+// @param code query string false "status code of the response (default 200), or header X-Echo-Code"
+// @param header query []string false "header of the response (Name: value), or headers X-Echo-Header"
+// @param delay query string false "delay before the response (ex 500ms, 2s), or header X-Echo-Delay"
+// @param size query int false "generated body of size bytes instead of the echo, or header X-Echo-Size"
+// @param content_type query string false "Content-Type of the response, or header X-Echo-Content-Type"
+// @param chunked query bool false "chunked transfer, or header X-Echo-Chunked"
+// @param chunk_size query int false "size of the chunks (default 1024), or header X-Echo-Chunk-Size"
+// @param chunk_delay query string false "delay between the chunks (ex 100ms), or header X-Echo-Chunk-Delay"
+// @param encoding query string false "gzip or br, or header X-Echo-Encoding"
+// @param close_after query int false "close the connection after close_after bytes of the body, or header X-Echo-Close-After"
+// @param request body string false "any content"
+// @produce application/json
+// @success 200 {object} echoResponse
+// @failure 400 string Bad Request
+// @failure 413 string Request Entity Too Large
+func echoHandler(c *gin.Context) {
+	l := requestLogger(c, "ECHO")
+	params := c.Request.URL.Query()
+	l.Infof("%s %s", c.Request.Method, c.Request.URL.Path)
+	l.Infof("query: %s", redactQuery(params))
+	l.Infof("headers: %s", redactHeaders(c.Request.Header))
+
+	shape, err := echoShapeFromRequest(c, l)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the body is returned in the echo (base64 for a binary content), it is limited by ECHO_MAX_SIZE
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, echoMaxSize()))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		l.Warnf("the body is larger than %d bytes", tooLarge.Limit)
+		c.String(http.StatusRequestEntityTooLarge, "the body is larger than %d bytes (ECHO_MAX_SIZE)", tooLarge.Limit)
+		return
+	}
+	if err != nil {
+		l.Errorf("%s", err.Error())
+	}
+	if len(body) > 0 {
+		l.Infof("body: %s", redactBody(body, c.ContentType()))
+	}
+
+	// the echo is not masked : the client receives its own request (the logs are masked)
+	response := echoResponse{
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Query:      params,
+		Headers:    c.Request.Header,
+		BodySize:   len(body),
+		Host:       c.Request.Host,
+		Protocol:   c.Request.Proto,
+		RemoteAddr: c.Request.RemoteAddr,
+		ClientIP:   c.ClientIP(),
+		Forwarded:  echoForwardedChain(c.Request.Header),
+	}
+	response.Body, response.BodyEncoding = echoBody(body, c.ContentType())
+	if c.Request.TLS != nil {
+		response.TLS = newTLSInfo(*c.Request.TLS)
+	}
+
+	// the body is the echo of the request in JSON, or a generated body of size bytes
+	var content io.Reader
+	var size int64
+	contentType := "application/json; charset=utf-8"
+	if shape.size >= 0 {
+		content, size = io.LimitReader(&echoPattern{}, shape.size), shape.size
+		contentType = "text/plain; charset=utf-8"
+	} else {
+		document, err := json.Marshal(response)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		content, size = bytes.NewReader(document), int64(len(document))
+	}
+	if !echoSleep(c, shape.delay) {
+		l.Warnf("the client is gone during the delay")
+		return
+	}
+	if err := echoWrite(c, shape, contentType, content, size); err != nil {
+		l.Warnf("%s", err.Error())
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- Shaping of the echo response
+
+const (
+	// echoPatternContent is repeated in the generated bodies
+	echoPatternContent = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ\n"
+	// echoBufferSize is the buffer of the streamed responses, whatever the chunk_size
+	echoBufferSize = 32 * 1024
+)
+
+// errEchoCloseAfter is returned when close_after bytes are written
+var errEchoCloseAfter = errors.New("close_after reached")
+
+// echoShape are the controls of the response, query parameters or X-Echo-* headers
+type echoShape struct {
+	code        int
+	headers     http.Header
+	delay       time.Duration
+	size        int64 // generated body, -1 for the echo of the request
+	contentType string
+	chunked     bool
+	chunkSize   int
+	chunkDelay  time.Duration
+	encoding    string // gzip or br
+	closeAfter  int64  // -1 to send the whole body
+}
+
+// echoOption returns the query parameter (ex delay) or the header X-Echo-* (ex X-Echo-Delay)
+func echoOption(c *gin.Context, name string) string {
+	if value := c.Query(name); len(value) > 0 {
+		return value
+	}
+	return c.GetHeader("X-Echo-" + strings.ReplaceAll(name, "_", "-"))
+}
+
+// echoMaxSize is ECHO_MAX_SIZE (default 10MB), the maximum of the request body and of the generated body
+func echoMaxSize() int64 {
+	maxSize, err := strconv.ParseInt(getenvs.GetEnvString("ECHO_MAX_SIZE", "10485760"), 10, 64)
+	if err != nil {
+		return 10485760
+	}
+	return maxSize
+}
+
+// echoShapeFromRequest reads the controls, the delays are limited by ECHO_MAX_DELAY (default 60s)
+// and the size by ECHO_MAX_SIZE (default 10MB)
+func echoShapeFromRequest(c *gin.Context, l *logger) (*echoShape, error) {
+	shape := &echoShape{code: http.StatusOK, headers: http.Header{}, size: -1, chunkSize: 1024, closeAfter: -1}
+	maxDelay, err := time.ParseDuration(getenvs.GetEnvString("ECHO_MAX_DELAY", "60s"))
+	if err != nil {
+		maxDelay = time.Minute
+	}
+	maxSize := echoMaxSize()
+
+	if value := echoOption(c, "code"); len(value) > 0 {
+		// an invalid code is ignored (200)
+		if code, err := strconv.Atoi(value); err == nil && code >= 100 && code <= 599 {
+			shape.code = code
+		}
+	}
+	for _, item := range append(c.QueryArray("header"), c.Request.Header.Values("X-Echo-Header")...) {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid header %q (Name: value expected)", item)
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		if name == "Content-Length" || name == "Transfer-Encoding" {
+			l.Warnf("the header %s is ignored", name)
+			continue
+		}
+		shape.headers.Add(name, strings.TrimSpace(parts[1]))
+	}
+	duration := func(name string) (time.Duration, error) {
+		value := echoOption(c, name)
+		if len(value) == 0 {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || d > maxDelay {
+			return 0, fmt.Errorf("invalid %s %q (duration up to %s expected)", name, value, maxDelay)
+		}
+		return d, nil
+	}
+	if shape.delay, err = duration("delay"); err != nil {
+		return nil, err
+	}
+	if shape.chunkDelay, err = duration("chunk_delay"); err != nil {
+		return nil, err
+	}
+	integer := func(name string, max int64) (int64, bool, error) {
+		value := echoOption(c, name)
+		if len(value) == 0 {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || n > max {
+			return 0, false, fmt.Errorf("invalid %s %q (0 to %d expected)", name, value, max)
+		}
+		return n, true, nil
+	}
+	if n, ok, err := integer("size", maxSize); err != nil {
+		return nil, err
+	} else if ok {
+		shape.size = n
+	}
+	if n, ok, err := integer("chunk_size", maxSize); err != nil {
+		return nil, err
+	} else if ok && n > 0 {
+		shape.chunkSize = int(n)
+	}
+	if n, ok, err := integer("close_after", maxSize); err != nil {
+		return nil, err
+	} else if ok {
+		shape.closeAfter = n
+	}
+	shape.contentType = echoOption(c, "content_type")
+	if value := echoOption(c, "chunked"); len(value) > 0 {
+		if shape.chunked, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid chunked %q (true or false expected)", value)
+		}
+	}
+	switch encoding := strings.ToLower(echoOption(c, "encoding")); encoding {
+	case "", "identity":
+	case "gzip", "br":
+		shape.encoding = encoding
+	default:
+		return nil, fmt.Errorf("invalid encoding %q (gzip or br expected)", encoding)
+	}
+	if echoNoBody(shape.code) && (shape.size > 0 || shape.chunked || len(shape.encoding) > 0 || shape.closeAfter >= 0) {
+		return nil, fmt.Errorf("the code %d has no body (size, chunked, encoding and close_after are not allowed)", shape.code)
+	}
+	return shape, nil
+}
+
+// echoNoBody returns true for the status codes without body (1xx, 204 and 304)
+func echoNoBody(code int) bool {
+	return code < 200 || code == http.StatusNoContent || code == http.StatusNotModified
+}
+
+// echoPattern generates the body of the size requested
+type echoPattern struct {
+	offset int
+}
+
+func (p *echoPattern) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = echoPatternContent[p.offset]
+		p.offset = (p.offset + 1) % len(echoPatternContent)
+	}
+	return len(b), nil
+}
+
+// echoEncoder is a gzip or brotli writer
+type echoEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEchoEncoder(w io.Writer, encoding string) echoEncoder {
+	if encoding == "br" {
+		return brotli.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// echoCounter counts the bytes written in the response, it stops at limit bytes (-1 without limit)
+// and returns errEchoCloseAfter
+type echoCounter struct {
+	w     io.Writer
+	n     int64
+	limit int64
+}
+
+func (cw *echoCounter) Write(b []byte) (int, error) {
+	if cw.limit >= 0 && cw.n+int64(len(b)) >= cw.limit {
+		n, err := cw.w.Write(b[:cw.limit-cw.n])
+		cw.n += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, errEchoCloseAfter
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// echoSleep waits the delay, it returns false when the client is gone
+func echoSleep(c *gin.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// echoClose sends the bytes written and closes the connection in the middle of the response
+func echoClose(c *gin.Context) error {
+	c.Writer.Flush()
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// echoWrite sends the body with the shape : headers, compression and chunked transfer (without Content-Length),
+// and close of the connection after close_after bytes of the response body (compressed when encoding is set)
+func echoWrite(c *gin.Context, shape *echoShape, contentType string, body io.Reader, size int64) error {
+	header := c.Writer.Header()
+	for name, values := range shape.headers {
+		header[name] = values
+	}
+	if echoNoBody(shape.code) {
+		c.Writer.WriteHeader(shape.code)
+		c.Writer.WriteHeaderNow()
+		return nil
+	}
+	if len(shape.contentType) > 0 {
+		header.Set("Content-Type", shape.contentType)
+	} else if len(header.Get("Content-Type")) == 0 {
+		header.Set("Content-Type", contentType)
+	}
+	if len(shape.encoding) > 0 {
+		header.Set("Content-Encoding", shape.encoding)
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	// the compressed body is streamed, its size is not known
+	if shape.chunked || len(shape.encoding) > 0 {
+		return echoWriteStream(c, shape, body)
+	}
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	c.Writer.WriteHeader(shape.code)
+	if shape.closeAfter >= 0 && shape.closeAfter < size {
+		if _, err := io.CopyN(c.Writer, body, shape.closeAfter); err != nil {
+			return err
+		}
+		return echoClose(c)
+	}
+	_, err := io.Copy(c.Writer, body)
+	return err
+}
+
+// echoWriteStream sends the body without Content-Length (chunked transfer encoding) through a buffer of
+// echoBufferSize bytes, with chunked the body is flushed every chunk_size bytes (before the compression) after
+// chunk_delay, the connection is closed after close_after bytes
+func echoWriteStream(c *gin.Context, shape *echoShape, body io.Reader) error {
+	c.Writer.WriteHeader(shape.code)
+	c.Writer.WriteHeaderNow()
+	counter := &echoCounter{w: c.Writer, limit: shape.closeAfter}
+	var out io.Writer = counter
+	var encoder echoEncoder
+	if len(shape.encoding) > 0 {
+		encoder = newEchoEncoder(counter, shape.encoding)
+		out = encoder
+	}
+
+	chunkSize := int64(math.MaxInt64)
+	if shape.chunked {
+		chunkSize = int64(shape.chunkSize)
+	}
+	reader := bufio.NewReaderSize(body, echoBufferSize)
+	buffer := make([]byte, echoBufferSize)
+	err := func() error {
+		for first := true; ; first = false {
+			if _, err := reader.Peek(1); err != nil {
+				// end of the body
+				return nil
+			}
+			if !first && !echoSleep(c, shape.chunkDelay) {
+				return c.Request.Context().Err()
+			}
+			if _, err := io.CopyBuffer(out, io.LimitReader(reader, chunkSize), buffer); err != nil {
+				return err
+			}
+			if encoder != nil {
+				if err := encoder.Flush(); err != nil {
+					return err
+				}
+			}
+			c.Writer.Flush()
+		}
+	}()
+	if err == nil && encoder != nil {
+		err = encoder.Close()
+	}
+	if errors.Is(err, errEchoCloseAfter) {
+		return echoClose(c)
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// the echo returns the request as received, the secrets are masked in the logs only
+func TestEchoHandlerSecrets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(&textLogHandler{mu: &sync.Mutex{}, out: redactWriter{&logs}, level: logLevel}))
+	defer slog.SetDefault(saved)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/echo?access_token=q5ecret&user=alice", strings.NewReader(`{"password":"b0dysecret"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.Header.Set("Authorization", "Basic YWxpY2U6aDNhZGVy")
+	c.Request.Header.Set("Cookie", "session=c00kie")
+	echoHandler(c)
+
+	var response struct {
+		Query   map[string][]string    `json:"query"`
+		Headers map[string][]string    `json:"headers"`
+		Body    map[string]interface{} `json:"body"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Query["access_token"][0] != "q5ecret" || response.Headers["Authorization"][0] != "Basic YWxpY2U6aDNhZGVy" ||
+		response.Headers["Cookie"][0] != "session=c00kie" || response.Body["password"] != "b0dysecret" {
+		t.Fatalf("the echo is modified : %s", w.Body.String())
+	}
+	for _, secret := range []string{"q5ecret", "YWxpY2U6aDNhZGVy", "c00kie", "b0dysecret"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("%s is in the logs :\n%s", secret, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "user:[alice]") {
+		t.Errorf("the query is not logged :\n%s", logs.String())
+	}
+}
+
+// the body of the request is limited by ECHO_MAX_SIZE
+func TestEchoHandlerBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ECHO_MAX_SIZE", "10")
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"0123456789", http.StatusOK},
+		{"0123456789a", http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/echo", strings.NewReader(test.body))
+		echoHandler(c)
+		if w.Code != test.status {
+			t.Errorf("body of %d bytes : status %d, %d expected", len(test.body), w.Code, test.status)
+		}
+	}
+}
+
+// the shaping of the response through a server : status, headers, generated body, chunked transfer, compression
+// and close of the connection
+func TestEchoShaping(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Any("/v1/echo", echoHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	pattern := func(size int) string {
+		body, _ := io.ReadAll(io.LimitReader(&echoPattern{}, int64(size)))
+		return string(body)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		header   http.Header
+		body     string
+		status   int
+		length   int64 // Content-Length, -1 for the chunked transfer
+		encoding string
+		want     string // body decoded, without check when empty
+		cut      int    // bytes received before the close of the connection
+	}{
+		{name: "code", query: "code=418&size=10", status: 418, length: 10, want: pattern(10)},
+		{name: "invalid code is ignored", query: "code=999&size=10", status: 200, length: 10, want: pattern(10)},
+		{name: "header", query: "size=0", header: http.Header{"X-Echo-Code": {"201"}}, status: 201, length: 0},
+		{name: "size", query: "size=100000", status: 200, length: 100000, want: pattern(100000)},
+		{name: "chunked", query: "size=5000&chunked=true&chunk_size=100", status: 200, length: -1, want: pattern(5000)},
+		{name: "gzip", query: "size=100000&encoding=gzip", status: 200, length: -1, encoding: "gzip", want: pattern(100000)},
+		{name: "br chunked", query: "size=100000&encoding=br&chunked=true&chunk_size=70000", status: 200, length: -1, encoding: "br", want: pattern(100000)},
+		{name: "close_after", query: "size=1000&close_after=100", status: 200, length: 1000, cut: 100},
+		{name: "close_after chunked", query: "size=1000&chunked=true&chunk_size=30&close_after=100", status: 200, length: -1, cut: 100},
+		{name: "close_after gzip", query: "size=100000&encoding=gzip&close_after=50", status: 200, length: -1, encoding: "gzip", cut: 50},
+		{name: "no content", query: "code=204", status: 204, length: 0},
+		{name: "not modified", query: "code=304", status: 304, length: 0},
+		{name: "no content with size", query: "code=204&size=10", status: 400, length: -2},
+		{name: "not modified with encoding", query: "code=304&encoding=gzip", status: 400, length: -2},
+		{name: "no content with close_after", query: "code=204&close_after=0", status: 400, length: -2},
+		{name: "no content for a PUT with a body", method: http.MethodPut, query: "code=204", body: `{"a":1}`, status: 204, length: 0},
+		{name: "not modified with a body", query: "code=304", body: "hello", status: 304, length: 0},
+		{name: "invalid encoding", query: "encoding=zstd", status: 400, length: -2},
+		{name: "size over the default maximum", query: "size=10485761", status: 400, length: -2},
+		{name: "invalid chunked", query: "chunked=yes", status: 400, length: -2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := http.MethodPost
+			if len(test.method) > 0 {
+				method = test.method
+			}
+			request, _ := http.NewRequest(method, server.URL+"/v1/echo?"+test.query, strings.NewReader(test.body))
+			for name, values := range test.header {
+				request.Header[name] = values
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != test.status {
+				t.Fatalf("status %d, %d expected", response.StatusCode, test.status)
+			}
+			if test.length >= -1 && response.ContentLength != test.length {
+				t.Fatalf("Content-Length %d, %d expected", response.ContentLength, test.length)
+			}
+			raw, err := io.ReadAll(response.Body)
+			if test.cut > 0 {
+				if err == nil || len(raw) != test.cut {
+					t.Fatalf("%d bytes received (error %v), the connection is not closed after %d bytes", len(raw), err, test.cut)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Header.Get("Content-Encoding") != test.encoding {
+				t.Fatalf("Content-Encoding %q, %q expected", response.Header.Get("Content-Encoding"), test.encoding)
+			}
+			var decoder io.Reader = bytes.NewReader(raw)
+			switch test.encoding {
+			case "gzip":
+				if decoder, err = gzip.NewReader(decoder); err != nil {
+					t.Fatal(err)
+				}
+			case "br":
+				decoder = brotli.NewReader(decoder)
+			}
+			body, err := io.ReadAll(decoder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(test.want) > 0 && string(body) != test.want {
+				t.Fatalf("body of %d bytes, %d expected", len(body), len(test.want))
+			}
+		})
+	}
+}
@@ -1,41 +1,55 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
-	"strings"
-	"time"
+	"os"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
-	getenvs "gitlab.com/avarf/getenvs"
+	jwt "github.com/golang-jwt/jwt/v4"
 )
 
 // Secret key to uniquely sign the token
 var key []byte
 
+// jwtSecretGenerated is true when MAGOVER_JWT_SECRET_KEY is not set and the secret is random
+var jwtSecretGenerated bool
+
+// errJWTUnauthorized is returned when the user or the password is wrong
+var errJWTUnauthorized = errors.New("unauthorized")
+
 // Credential User's login information
 type Credential struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
-// Token jwt Standard Claim Object
+// Token jwt Standard Claim Object (iss, sub, aud, exp, nbf, iat, jti)
 type Token struct {
-	Username string `json:"username"`
-	jwt.StandardClaims
-}
-
-// Create a dummy local db instance as a key value pair
-var userdb = map[string]string{
-	"jwtuser1": "pa$$W0rd1",
+	Username string   `json:"username"`
+	TokenUse string   `json:"token_use,omitempty"` // access or refresh
+	Roles    []string `json:"roles,omitempty"`     // JWT_USER_ROLES
+	Scope    string   `json:"scope,omitempty"`     // JWT_USER_SCOPES, separated by a space
+	ClientID string   `json:"client_id,omitempty"` // OIDC client of the token
+	jwt.RegisteredClaims
 }
 
 // assign the secret key to key variable on program's first run
 func init() {
-	// read the secret_key from the environment variables
-	key = []byte(getenvs.GetEnvString("MAGOVER_JWT_SECRET_KEY", "james8ond"))
+	// read the secret_key from the environment variables, without it the secret is random (a known default
+	// would let anyone sign tokens)
+	key = []byte(os.Getenv("MAGOVER_JWT_SECRET_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		jwtSecretGenerated = true
+	}
+
+	registerBatchJob("jwt", "get a JWT token and validate it", `{"username": "jwtuser1", "password": "pa$$W0rd1"}`, batchJobJWT)
 }
 
 // ---- swagger Informations
@@ -45,7 +59,7 @@ func init() {
 // @consume application/json
 // @param data body Credential false "Your credential"
 // @produce application/json
-// @success 200 string OK
+// @success 200 {object} jwtTokenResponse
 // @failure 401 string Unauthorized
 // @failure 500 string Internal Server Error
 func jwtLoginHandler(c *gin.Context) {
@@ -59,93 +73,97 @@ func jwtLoginHandler(c *gin.Context) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// verify if user exist or not
-	userPassword, ok := userdb[creds.Username]
-
-	// if user exist, verify the password
-	if !ok || userPassword != creds.Password {
-		w.WriteHeader(http.StatusUnauthorized)
+	l := requestLogger(c, "JWT/LOGIN")
+	tokens, err := jwtNewToken(creds, l)
+	if err != nil {
+		if errors.Is(err, errJWTUnauthorized) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		l.Errorf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	c.JSON(http.StatusOK, tokens)
+}
 
-	// Create a token object and add the Username and StandardClaims
-	var tokenClaim = Token{
-		Username: creds.Username,
-		StandardClaims: jwt.StandardClaims{
-			// Enter expiration in milisecond
-			ExpiresAt: time.Now().Add(10 * time.Minute).Unix(),
-		},
+// jwtNewToken checks the credential and returns the signed access and refresh tokens
+func jwtNewToken(creds Credential, l *logger) (*jwtTokenResponse, error) {
+	// verify the user and the password with the store of JWT_USER_STORE
+	if err := jwtAuthenticate(creds.Username, creds.Password, l); err != nil {
+		return nil, err
 	}
+	return jwtIssueTokens(creds.Username, nil)
+}
 
-	// Create a new claim with HS256 algorithm and token claim
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaim)
-
-	tokenString, err := token.SignedString(key)
+// jwtSign signs the claims with the signing key (HS256 by default)
+func jwtSign(claims jwt.Claims) (string, error) {
+	method, signingKey, kid, err := jwtKeys.signer()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if len(kid) > 0 {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(signingKey)
+}
 
+// function for Job
+func batchJobJWT(argValues string) (interface{}, error) {
+	var creds Credential
+	if err := parseBatchArgument(argValues, &creds); err != nil {
+		return nil, err
+	}
+	tokens, err := jwtNewToken(creds, newLogger("BATCH/JWT"))
 	if err != nil {
-		log.Printf("[JWT/LOGIN] ERROR: %s", err)
+		return nil, err
 	}
-	json.NewEncoder(w).Encode(tokenString)
+	// validate the token we just signed
+	token, err := ValidateToken("Bearer " + tokens.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	user := token.Claims.(*Token)
+	return gin.H{
+		"username":   user.Username,
+		"jti":        user.ID,
+		"expiration": user.ExpiresAt.Time,
+	}, nil
 }
 
 // ---- swagger Informations
 // @Tags         JWT
 // @router /v1/jwt/test [get]
-// @summary Test JWT token
+// @summary Test JWT token (header Authorization, cookie access_token or query access_token)
 // @security BearerAuth
 // @success 200 string OK
 // @failure 401 string Unauthorized
 // @failure 500 string Internal Server Error
 func jwtTestHandler(c *gin.Context) {
-	var w http.ResponseWriter = c.Writer
-	var r *http.Request = c.Request
-
-	// get the bearer token from the reuest header
-	bearerToken := r.Header.Get("Authorization")
-
-	// validate token, it will return Token and error
-	token, err := ValidateToken(bearerToken)
-
-	if err != nil {
-		// check if Error is Signature Invalid Error
-		if err == jwt.ErrSignatureInvalid {
-			// return the Unauthorized Status
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		// Return the Bad Request for any other error
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	// Validate the token if it expired or not
-	if !token.Valid {
-		// return the Unauthoried Status for expired token
-		w.WriteHeader(http.StatusUnauthorized)
+	// the token is validated by the middleware jwtRequire
+	user := jwtClaims(c)
+	if user == nil {
+		c.Writer.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-
-	// Type cast the Claims to *Token type
-	user := token.Claims.(*Token)
-
-	// send the username Dashboard message
-	//json.NewEncoder(w).Encode(fmt.Sprintf("%s Dashboard", user.Username))
 	c.JSON(http.StatusOK, gin.H{
 		"message":    "Welcome " + user.Username,
-		"expiration": time.Unix(user.ExpiresAt, 0),
+		"expiration": user.ExpiresAt.Time,
+		"roles":      user.Roles,
+		"scope":      user.Scope,
 	})
 }
 
-// ValidateToken validates the token with the secret key and return the object
+// ValidateToken validates the access token (signature, expiration, issuer, audience, deny list) and return the object
 func ValidateToken(bearerToken string) (*jwt.Token, error) {
 
-	// format the token string
-	tokenString := strings.Split(bearerToken, " ")[1]
-
-	// Parse the token with tokenObj
-	token, err := jwt.ParseWithClaims(tokenString, &Token{}, func(token *jwt.Token) (interface{}, error) {
-		return key, nil
-	})
+	// format the token string (Bearer <token>)
+	tokenString, err := jwtHeaderToken(bearerToken)
+	if err != nil {
+		return nil, err
+	}
 
-	// return token and err
-	return token, err
+	// Parse the token with tokenObj, the key is selected with the kid of the header
+	return jwtParseToken(tokenString, jwtAccessToken)
 }
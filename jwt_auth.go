@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- JWT authentication of the routes
+
+const (
+	// jwtAuthClaimsKey is the key of the claims (*Token) in the gin context
+	jwtAuthClaimsKey = "jwt_claims"
+	// jwtAuthUserKey is the key of the authenticated user in the gin context
+	jwtAuthUserKey = "jwt_user"
+)
+
+var (
+	// errJWTMissing is returned when the request has no bearer token
+	errJWTMissing = errors.New("bearer token required")
+	// errJWTForbidden is returned when the token has not the role or the scope required
+	errJWTForbidden = errors.New("insufficient role or scope")
+)
+
+// jwtHeaderToken returns the token of the header Authorization (Bearer <token>)
+func jwtHeaderToken(header string) (string, error) {
+	fields := strings.Fields(header)
+	if len(fields) == 0 {
+		return "", errJWTMissing
+	}
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") {
+		return "", fmt.Errorf("%w (Authorization: Bearer expected)", errJWTInvalid)
+	}
+	return fields[1], nil
+}
+
+// jwtRequestToken returns the bearer token of the header Authorization, of the cookie JWT_AUTH_COOKIE
+// (default access_token) or of the query parameter access_token
+func jwtRequestToken(c *gin.Context) (string, error) {
+	if header := c.GetHeader("Authorization"); len(header) > 0 {
+		return jwtHeaderToken(header)
+	}
+	if cookie, err := c.Cookie(getenvs.GetEnvString("JWT_AUTH_COOKIE", "access_token")); err == nil && len(cookie) > 0 {
+		return cookie, nil
+	}
+	if query := c.Query("access_token"); len(query) > 0 {
+		return query, nil
+	}
+	return "", errJWTMissing
+}
+
+// jwtUserClaims returns the values of the user in a list of user=value1 value2 separated by a comma
+// (JWT_USER_ROLES, JWT_USER_SCOPES), the values of * are given to all the users
+func jwtUserClaims(name string, username string) []string {
+	values := []string{}
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) == 2 && (parts[0] == username || parts[0] == "*") {
+			values = append(values, strings.Fields(parts[1])...)
+		}
+	}
+	return values
+}
+
+// jwtHasAll returns true when all the required values are in the values
+func jwtHasAll(values []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, v := range values {
+			found = found || v == r
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// jwtAuthorize checks the claims : one of the roles (when roles is not empty) and all the scopes are required
+func jwtAuthorize(claims *Token, roles []string, scopes []string) error {
+	if len(roles) > 0 {
+		member := false
+		for _, role := range roles {
+			for _, r := range claims.Roles {
+				member = member || r == role
+			}
+		}
+		if !member {
+			return fmt.Errorf("%w (one of the roles %s required)", errJWTForbidden, strings.Join(roles, ", "))
+		}
+	}
+	if !jwtHasAll(strings.Fields(claims.Scope), scopes) {
+		return fmt.Errorf("%w (scopes %s required)", errJWTForbidden, strings.Join(scopes, " "))
+	}
+	return nil
+}
+
+// jwtUnauthorized returns 401 with the error in the header WWW-Authenticate (RFC 6750)
+func jwtUnauthorized(c *gin.Context, err error) {
+	if errors.Is(err, errJWTMissing) {
+		c.Header("WWW-Authenticate", `Bearer realm="Macgover"`)
+	} else {
+		c.Header("WWW-Authenticate", `Bearer realm="Macgover", error="invalid_token"`)
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// jwtRequire returns a middleware which requires a valid access token, one of the roles (when roles is not empty)
+// and all the scopes, the claims are set in the gin context (jwtClaims)
+func jwtRequire(roles []string, scopes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		l := requestLogger(c, "JWT/AUTH")
+		tokenString, err := jwtRequestToken(c)
+		if err != nil {
+			l.Debugf("%s", err.Error())
+			jwtUnauthorized(c, err)
+			return
+		}
+		token, err := jwtParseToken(tokenString, jwtAccessToken)
+		if err != nil {
+			var validationError *jwt.ValidationError
+			if errors.As(err, &validationError) || errors.Is(err, errJWTRevoked) || errors.Is(err, errJWTInvalid) {
+				l.Warnf("authentication refused, %v", err)
+				jwtUnauthorized(c, err)
+				return
+			}
+			// the deny list is not readable
+			l.Errorf("%s", err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		claims := token.Claims.(*Token)
+		if err := jwtAuthorize(claims, roles, scopes); err != nil {
+			l.Warnf("%s refused, %s", claims.Username, err.Error())
+			c.Header("WWW-Authenticate", `Bearer realm="Macgover", error="insufficient_scope"`)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		l.Debugf("%s authenticated (jti=%s)", claims.Username, claims.ID)
+		c.Set(jwtAuthClaimsKey, claims)
+		c.Set(jwtAuthUserKey, claims.Username)
+		c.Next()
+	}
+}
+
+// jwtClaims returns the claims of the token validated by the middleware (nil without middleware)
+func jwtClaims(c *gin.Context) *Token {
+	claims, _ := c.Get(jwtAuthClaimsKey)
+	token, _ := claims.(*Token)
+	return token
+}
+
+// jwtAuth returns a middleware which requires a JWT when the group of routes is in JWT_AUTH_ROUTES,
+// with the roles JWT_AUTH_ROLES_<ROUTES> (one of) and the scopes JWT_AUTH_SCOPES_<ROUTES> (all)
+func jwtAuth(routes string) gin.HandlerFunc {
+	if !authRouteEnabled("JWT_AUTH_ROUTES", routes) {
+		return func(c *gin.Context) { c.Next() }
+	}
+	split := func(r rune) bool { return r == ',' || r == ' ' }
+	roles := strings.FieldsFunc(os.Getenv("JWT_AUTH_ROLES_"+strings.ToUpper(routes)), split)
+	scopes := strings.FieldsFunc(os.Getenv("JWT_AUTH_SCOPES_"+strings.ToUpper(routes)), split)
+	newLogger("JWT/AUTH").Infof("the routes %s require a JWT (roles=%v scopes=%v)", routes, roles, scopes)
+	return jwtRequire(roles, scopes)
+}
+
+// --------------------------- groups of routes of LDAP_AUTH_ROUTES and JWT_AUTH_ROUTES
+
+// authRouteGroups are the groups of routes which can be protected, all is every route of /v1 except authPublicRoutes
+var authRouteGroups = []string{"echo", "db", "network", "all"}
+
+// authPublicRoutes are not protected by all : the logins deliver the tokens and the admin endpoints check their own token
+var authPublicRoutes = []string{"/v1/jwt/login", "/v1/jwt/refresh", "/v1/oidc/authorize", "/v1/oidc/token", "/v1/admin/"}
+
+// authRoutes returns the groups of routes of the variable (LDAP_AUTH_ROUTES or JWT_AUTH_ROUTES), an unknown group is an error
+func authRoutes(variable string) ([]string, error) {
+	routes := strings.FieldsFunc(strings.ToLower(os.Getenv(variable)), func(r rune) bool { return r == ',' || r == ' ' })
+	for _, r := range routes {
+		known := false
+		for _, g := range authRouteGroups {
+			known = known || r == g
+		}
+		if !known {
+			return nil, fmt.Errorf("%s : unknown group of routes %s (%s)", variable, r, strings.Join(authRouteGroups, ", "))
+		}
+	}
+	return routes, nil
+}
+
+// validateAuthRoutes checks LDAP_AUTH_ROUTES and JWT_AUTH_ROUTES at the start of the server
+func validateAuthRoutes() error {
+	for _, variable := range []string{"LDAP_AUTH_ROUTES", "JWT_AUTH_ROUTES"} {
+		if _, err := authRoutes(variable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authRouteEnabled returns true when the group of routes is in the variable, the groups are not protected
+// by their own middleware when all is set (the middleware of /v1 protects them)
+func authRouteEnabled(variable string, routes string) bool {
+	list, _ := authRoutes(variable)
+	enabled, all := false, false
+	for _, r := range list {
+		enabled = enabled || r == routes
+		all = all || r == "all"
+	}
+	return enabled && (routes == "all" || !all)
+}
+
+// routeAuth returns the middleware of a group of routes (echo, db, network or all) : the LDAP Basic authentication
+// (LDAP_AUTH_ROUTES) or the JWT (JWT_AUTH_ROUTES), when the group is in both variables they are alternatives,
+// the requests with Authorization: Basic are checked with the ldap and the others with the JWT
+func routeAuth(routes string) gin.HandlerFunc {
+	ldapEnabled, jwtEnabled := authRouteEnabled("LDAP_AUTH_ROUTES", routes), authRouteEnabled("JWT_AUTH_ROUTES", routes)
+	ldapMiddleware, jwtMiddleware := ldapAuth(routes), jwtAuth(routes)
+	return func(c *gin.Context) {
+		if routes == "all" {
+			for _, public := range authPublicRoutes {
+				if c.Request.URL.Path == public || (strings.HasSuffix(public, "/") && strings.HasPrefix(c.Request.URL.Path, public)) {
+					c.Next()
+					return
+				}
+			}
+		}
+		fields := strings.Fields(c.GetHeader("Authorization"))
+		basic := len(fields) > 0 && strings.EqualFold(fields[0], "Basic")
+		switch {
+		case ldapEnabled && (basic || !jwtEnabled):
+			ldapMiddleware(c)
+		case jwtEnabled:
+			jwtMiddleware(c)
+		default:
+			c.Next()
+		}
+	}
+}
+
+// jwtAdminAuthorized accepts the admin token (MACGOVER_ADMIN_TOKEN) or an access token with the role JWT_ADMIN_ROLE
+// (default admin) in the header Authorization, the cookies are not read (the admin endpoints change the state)
+func jwtAdminAuthorized(c *gin.Context) bool {
+	l := requestLogger(c, "ADMIN")
+	tokenString, err := jwtHeaderToken(c.GetHeader("Authorization"))
+	if err != nil {
+		l.Warnf("%s refused, %s", c.Request.URL.Path, err.Error())
+		jwtUnauthorized(c, err)
+		return false
+	}
+	if admin := os.Getenv("MACGOVER_ADMIN_TOKEN"); len(admin) > 0 && subtle.ConstantTimeCompare([]byte(tokenString), []byte(admin)) == 1 {
+		return true
+	}
+	token, err := jwtParseToken(tokenString, jwtAccessToken)
+	if err != nil {
+		var validationError *jwt.ValidationError
+		if errors.As(err, &validationError) || errors.Is(err, errJWTRevoked) || errors.Is(err, errJWTInvalid) {
+			l.Warnf("%s refused, %v", c.Request.URL.Path, err)
+			jwtUnauthorized(c, err)
+			return false
+		}
+		l.Errorf("%s", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	claims := token.Claims.(*Token)
+	if err := jwtAuthorize(claims, []string{getenvs.GetEnvString("JWT_ADMIN_ROLE", "admin")}, nil); err != nil {
+		l.Warnf("%s refused for %s, %s", c.Request.URL.Path, claims.Username, err.Error())
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+	l.Infof("%s authorized for %s", c.Request.URL.Path, claims.Username)
+	return true
+}
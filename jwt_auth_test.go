@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthRouteEnabled(t *testing.T) {
+	tests := []struct {
+		routes  string
+		group   string
+		enabled bool
+	}{
+		{"", "echo", false},
+		{"echo,db", "echo", true},
+		{"echo, db", "db", true},
+		{"echo", "network", false},
+		{"echo", "all", false},
+		{"all", "all", true},
+		// the middleware of /v1 protects the groups
+		{"all,echo", "echo", false},
+		{"ALL", "all", true},
+	}
+	for _, test := range tests {
+		t.Setenv("JWT_AUTH_ROUTES", test.routes)
+		if got := authRouteEnabled("JWT_AUTH_ROUTES", test.group); got != test.enabled {
+			t.Errorf("JWT_AUTH_ROUTES=%q %s : %v, %v expected", test.routes, test.group, got, test.enabled)
+		}
+	}
+
+	t.Setenv("JWT_AUTH_ROUTES", "echo,ldap")
+	if err := validateAuthRoutes(); err == nil {
+		t.Errorf("the unknown group ldap is accepted")
+	}
+	t.Setenv("JWT_AUTH_ROUTES", "all")
+	t.Setenv("LDAP_AUTH_ROUTES", "echo db network")
+	if err := validateAuthRoutes(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRouteAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("JWT_AUTH_ROUTES", "all")
+	t.Setenv("LDAP_AUTH_ROUTES", "all")
+	// unreachable ldap : the Basic authentications fail
+	t.Setenv("LDAP_URL", "ldap://127.0.0.1:1")
+	tokens, err := jwtIssueTokens("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	v1 := router.Group("/v1", routeAuth("all"))
+	for _, path := range []string{"/ping", "/healthcheck", "/url", "/jwt/login", "/oidc/token", "/admin/loglevel", "/echo", "/db/target"} {
+		v1.GET(path, func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	}
+	tests := []struct {
+		path   string
+		header string
+		status int
+	}{
+		{"/v1/ping", "", http.StatusUnauthorized},
+		{"/v1/healthcheck", "", http.StatusUnauthorized},
+		{"/v1/url", "Bearer x.y.z", http.StatusUnauthorized},
+		{"/v1/db/target", "Bearer " + tokens.AccessToken, http.StatusOK},
+		{"/v1/echo", "Bearer " + tokens.RefreshToken, http.StatusUnauthorized},
+		{"/v1/jwt/login", "", http.StatusOK},
+		{"/v1/oidc/token", "", http.StatusOK},
+		{"/v1/admin/loglevel", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if len(test.header) > 0 {
+				r.Header.Set("Authorization", test.header)
+			}
+			router.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Fatalf("status %d, %d expected", w.Code, test.status)
+			}
+		})
+	}
+
+	// the Basic authentication is checked with the ldap only, not as a JWT
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v1/echo", nil)
+	r.SetBasicAuth("alice", "secret")
+	router.ServeHTTP(w, r)
+	if w.Code == http.StatusOK || w.Header().Get("WWW-Authenticate") == `Bearer realm="Macgover", error="invalid_token"` {
+		t.Fatalf("Basic authentication : status %d (%s)", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
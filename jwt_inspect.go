@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// --------------------------- JWT inspection
+
+// errJWTInspectArgument is returned when the token cannot be decoded
+var errJWTInspectArgument = errors.New("invalid JWT")
+
+// jwtInspectRequest is the token to decode, with the key to verify the signature (optional)
+type jwtInspectRequest struct {
+	Token     string `json:"token"`
+	Secret    string `json:"secret,omitempty"`     // HMAC secret (HS256, HS384, HS512)
+	PublicKey string `json:"public_key,omitempty"` // PEM public key or certificate
+	JWKSURL   string `json:"jwks_url,omitempty"`   // ex https://issuer/.well-known/jwks.json
+}
+
+type jwtVerification struct {
+	Method   string `json:"method"` // secret, public_key or jwks_url
+	Verified bool   `json:"verified"`
+	Error    string `json:"error,omitempty"`
+}
+
+type jwtInspectResult struct {
+	Header       map[string]interface{} `json:"header"`
+	Claims       map[string]interface{} `json:"claims"`
+	IssuedAt     *time.Time             `json:"issued_at,omitempty"`
+	NotBefore    *time.Time             `json:"not_before,omitempty"`
+	ExpiresAt    *time.Time             `json:"expires_at,omitempty"`
+	ExpiresIn    string                 `json:"expires_in,omitempty"`
+	Expired      bool                   `json:"expired"`
+	NotYetValid  bool                   `json:"not_yet_valid"`
+	Verification *jwtVerification       `json:"verification,omitempty"`
+}
+
+func init() {
+	registerBatchJob("jwtinspect", "decode a JWT and verify its signature", `{"token": "eyJ...", "jwks_url": "https://issuer/.well-known/jwks.json"}`, batchJobJWTInspect)
+}
+
+// jwtClaimTime returns the date of a NumericDate claim (exp, nbf, iat)
+func jwtClaimTime(claims jwt.MapClaims, name string) *time.Time {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return nil
+	}
+	t := time.Unix(int64(value), 0).UTC()
+	return &t
+}
+
+// jwtInspect decodes the token and verifies the signature when a key is given
+func jwtInspect(req jwtInspectRequest, l *logger) (*jwtInspectResult, error) {
+	tokenString := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(req.Token), "Bearer "))
+	if len(tokenString) == 0 {
+		return nil, fmt.Errorf("%w: token is required", errJWTInspectArgument)
+	}
+	claims := jwt.MapClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errJWTInspectArgument, err.Error())
+	}
+
+	now := time.Now()
+	result := &jwtInspectResult{
+		Header:    token.Header,
+		Claims:    claims,
+		IssuedAt:  jwtClaimTime(claims, "iat"),
+		NotBefore: jwtClaimTime(claims, "nbf"),
+		ExpiresAt: jwtClaimTime(claims, "exp"),
+	}
+	if result.ExpiresAt != nil {
+		result.Expired = now.After(*result.ExpiresAt)
+		if !result.Expired {
+			result.ExpiresIn = result.ExpiresAt.Sub(now).Round(time.Second).String()
+		}
+	}
+	if result.NotBefore != nil {
+		result.NotYetValid = now.Before(*result.NotBefore)
+	}
+
+	var keyFunc jwt.Keyfunc
+	switch {
+	case len(req.Secret) > 0:
+		result.Verification = &jwtVerification{Method: "secret"}
+		keyFunc = func(t *jwt.Token) (interface{}, error) { return []byte(req.Secret), nil }
+	case len(req.PublicKey) > 0:
+		result.Verification = &jwtVerification{Method: "public_key"}
+		keyFunc = func(t *jwt.Token) (interface{}, error) { return jwtParsePublicKey(req.PublicKey) }
+	case len(req.JWKSURL) > 0:
+		result.Verification = &jwtVerification{Method: "jwks_url"}
+		keyFunc = func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return jwtFetchJWKSKey(req.JWKSURL, kid, l)
+		}
+	default:
+		return result, nil
+	}
+
+	// only the signature is verified, the dates are reported above
+	_, err = jwt.NewParser(jwt.WithoutClaimsValidation()).Parse(tokenString, keyFunc)
+	if err != nil {
+		result.Verification.Error = err.Error()
+		l.Infof("signature not verified (%s), %s", result.Verification.Method, err.Error())
+	} else {
+		result.Verification.Verified = true
+	}
+	return result, nil
+}
+
+// jwtParsePublicKey reads a PEM public key (PKIX, PKCS#1) or certificate
+func jwtParsePublicKey(content string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(content))
+	if block == nil {
+		return nil, errors.New("no PEM block found in public_key")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// jwtFetchJWKSKey downloads the JWKS and returns the key of the kid (or the only key without kid)
+func jwtFetchJWKSKey(jwksURL string, kid string, l *logger) (crypto.PublicKey, error) {
+	l.Debugf("JWKS=%s kid=%s", jwksURL, kid)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", jwksURL, resp.StatusCode)
+	}
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("JWKS : %s", err.Error())
+	}
+	return set.publicKey(kid)
+}
+
+// publicKey returns the key of the kid (or the only key without kid)
+func (set jwks) publicKey(kid string) (crypto.PublicKey, error) {
+	for _, key := range set.Keys {
+		if key.Kid == kid || (len(kid) == 0 && len(set.Keys) == 1) {
+			return key.publicKey()
+		}
+	}
+	return nil, fmt.Errorf("kid %q not found in the JWKS (%d keys)", kid, len(set.Keys))
+}
+
+// publicKey returns the public key of the JWK (RSA, EC or OKP Ed25519)
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(value) }
+	switch j.Kty {
+	case "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[j.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %s", j.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", j.Kty)
+}
+
+// ---- swagger Informations
+// @Tags         JWT
+// @router /v1/jwt/inspect [post]
+// @summary Decode a JWT (header, claims, dates) and verify its signature with a secret, a PEM public key or a JWKS URL
+// @consume application/json
+// @param data body jwtInspectRequest true "Token and optional key"
+// @produce application/json
+// @success 200 {object} jwtInspectResult
+// @failure 400 string Bad Request
+func jwtInspectHandler(c *gin.Context) {
+	var req jwtInspectRequest
+	if err := c.ShouldBindJSON(&req); err != nil && len(c.GetHeader("Authorization")) == 0 {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	// the token of the header Authorization is inspected when the body has no token
+	if len(req.Token) == 0 {
+		req.Token = c.GetHeader("Authorization")
+	}
+	result, err := jwtInspect(req, requestLogger(c, "JWT/INSPECT"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// function for Job
+func batchJobJWTInspect(argValues string) (interface{}, error) {
+	var req jwtInspectRequest
+	if err := parseBatchArgument(argValues, &req); err != nil {
+		return nil, err
+	}
+	result, err := jwtInspect(req, newLogger("BATCH/JWT"))
+	if errors.Is(err, errJWTInspectArgument) {
+		return nil, fmt.Errorf("%w: %s", errBatchArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.Verification != nil && !result.Verification.Verified {
+		return result, fmt.Errorf("signature not verified : %s", result.Verification.Error)
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func TestJWTInspect(t *testing.T) {
+	l := newLogger("TEST")
+	ring := &jwtKeyRing{alg: "ES256"}
+	if err := ring.rotate(l); err != nil {
+		t.Fatal(err)
+	}
+	other := &jwtKeyRing{alg: "ES256"}
+	if err := other.rotate(l); err != nil {
+		t.Fatal(err)
+	}
+	signing := ring.keys[0]
+	publicPEM := func(k *jwtKey) string {
+		der, err := x509.MarshalPKIXPublicKey(k.private.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ring.jwks())
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	claims := jwt.MapClaims{"sub": "alice", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+	sign := func(method jwt.SigningMethod, claims jwt.MapClaims, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		if len(kid) > 0 {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	hs256 := sign(jwt.SigningMethodHS256, claims, "", []byte("s3cret"))
+	es256 := sign(signing.method, claims, signing.kid, signing.private)
+
+	tests := []struct {
+		name        string
+		req         jwtInspectRequest
+		invalid     bool // errJWTInspectArgument
+		expired     bool
+		notYetValid bool
+		method      string // method of the verification, empty without key
+		verified    bool
+	}{
+		{name: "empty", req: jwtInspectRequest{Token: " "}, invalid: true},
+		{name: "malformed", req: jwtInspectRequest{Token: "not.a.jwt"}, invalid: true},
+		{name: "two segments", req: jwtInspectRequest{Token: "eyJhbGciOiJIUzI1NiJ9.e30"}, invalid: true},
+		{name: "decoded without key", req: jwtInspectRequest{Token: "Bearer " + hs256}},
+		{name: "expired", req: jwtInspectRequest{Token: sign(jwt.SigningMethodHS256, jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}, "", []byte("s3cret")), Secret: "s3cret"},
+			expired: true, method: "secret", verified: true},
+		{name: "not yet valid", req: jwtInspectRequest{Token: sign(jwt.SigningMethodHS256, jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()}, "", []byte("s3cret")), Secret: "s3cret"},
+			notYetValid: true, method: "secret", verified: true},
+		{name: "secret", req: jwtInspectRequest{Token: hs256, Secret: "s3cret"}, method: "secret", verified: true},
+		{name: "wrong secret", req: jwtInspectRequest{Token: hs256, Secret: "other"}, method: "secret"},
+		{name: "public key", req: jwtInspectRequest{Token: es256, PublicKey: publicPEM(signing)}, method: "public_key", verified: true},
+		{name: "other public key", req: jwtInspectRequest{Token: es256, PublicKey: publicPEM(other.keys[0])}, method: "public_key"},
+		{name: "invalid PEM", req: jwtInspectRequest{Token: es256, PublicKey: "not a key"}, method: "public_key"},
+		{name: "jwks", req: jwtInspectRequest{Token: es256, JWKSURL: server.URL}, method: "jwks_url", verified: true},
+		{name: "jwks unknown kid", req: jwtInspectRequest{Token: sign(signing.method, claims, "unknown", signing.private), JWKSURL: server.URL}, method: "jwks_url"},
+		{name: "jwks other key", req: jwtInspectRequest{Token: sign(other.keys[0].method, claims, signing.kid, other.keys[0].private), JWKSURL: server.URL}, method: "jwks_url"},
+		// HS256 signed with the public key as secret, checked with the public key
+		{name: "alg mismatch HS256 with a public key", req: jwtInspectRequest{Token: sign(jwt.SigningMethodHS256, claims, "", []byte(publicPEM(signing))), PublicKey: publicPEM(signing)},
+			method: "public_key"},
+		{name: "alg mismatch ES256 with a secret", req: jwtInspectRequest{Token: es256, Secret: "s3cret"}, method: "secret"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := jwtInspect(test.req, l)
+			if test.invalid {
+				if !errors.Is(err, errJWTInspectArgument) {
+					t.Fatalf("error %v, %v expected", err, errJWTInspectArgument)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Expired != test.expired || result.NotYetValid != test.notYetValid {
+				t.Fatalf("expired %v, not yet valid %v", result.Expired, result.NotYetValid)
+			}
+			if len(test.method) == 0 {
+				if result.Verification != nil || result.Claims["sub"] != "alice" || result.ExpiresAt == nil || len(result.ExpiresIn) == 0 {
+					t.Fatalf("result %+v", result)
+				}
+				return
+			}
+			if result.Verification == nil || result.Verification.Method != test.method || result.Verification.Verified != test.verified {
+				t.Fatalf("verification %+v, %s verified %v expected", result.Verification, test.method, test.verified)
+			}
+			if !test.verified && len(result.Verification.Error) == 0 {
+				t.Fatalf("the verification failed without error")
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- JWT signing keys
+
+// errJWTSymmetric is returned by the rotation with HS256
+var errJWTSymmetric = errors.New("rotation requires an asymmetric JWT_ALGORITHM (RS256, ES256 or EdDSA)")
+
+// jwtKey is a key of the key ring, the kid is the JWK thumbprint of the public key (RFC 7638)
+type jwtKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	// retired is the time of the rotation which replaced the key (zero for the signing key)
+	retired time.Time
+}
+
+// jwk is the public key in the JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwtKeyRing contains the asymmetric keys, the first one signs the tokens, the others validate
+// the tokens signed before a rotation
+type jwtKeyRing struct {
+	mu   sync.RWMutex
+	alg  string
+	keys []*jwtKey
+}
+
+var (
+	jwtKeys     = &jwtKeyRing{}
+	jwtKeysOnce sync.Once
+)
+
+func init() {
+	registerBatchJob("jwks", "display the public keys used to sign the JWT (JWKS)", `{}`, batchJobJWKS)
+}
+
+// initJWTKeys loads the keys of JWT_PRIVATE_KEYS or generates a key for JWT_ALGORITHM (only once)
+func initJWTKeys() {
+	jwtKeysOnce.Do(func() {
+		l := newLogger("JWT/KEYS")
+		alg := strings.ToUpper(getenvs.GetEnvString("JWT_ALGORITHM", "HS256"))
+		if alg == "EDDSA" {
+			alg = "EdDSA"
+		}
+		jwtKeys.alg = alg
+
+		for _, file := range strings.Split(os.Getenv("JWT_PRIVATE_KEYS"), ",") {
+			file = strings.TrimSpace(file)
+			if len(file) == 0 {
+				continue
+			}
+			k, err := jwtLoadKey(file)
+			if err != nil {
+				l.Errorf("%s : %s", file, err.Error())
+				continue
+			}
+			jwtKeys.keys = append(jwtKeys.keys, k)
+			l.Infof("key %s (%s) loaded from %s", k.kid, k.method.Alg(), file)
+		}
+		if len(jwtKeys.keys) > 0 {
+			jwtKeys.alg = jwtKeys.keys[0].method.Alg()
+			return
+		}
+		if alg == "HS256" && !oidcEnabled() {
+			if jwtSecretGenerated {
+				l.Warnf("MAGOVER_JWT_SECRET_KEY is not set, the HS256 secret is generated, the tokens are not valid after a restart")
+			}
+			return
+		}
+		if alg == "HS256" {
+			// the clients of the OIDC provider validate the id_token with the JWKS
+			l.Warnf("the OIDC provider requires an asymmetric key, RS256 is used instead of HS256")
+			alg = "RS256"
+			jwtKeys.alg = alg
+		}
+
+		// without JWT_PRIVATE_KEYS, the key is generated and the tokens are not valid after a restart
+		if err := jwtKeys.rotate(l); err != nil {
+			l.Errorf("%s", err.Error())
+			return
+		}
+		l.Warnf("the %s key is generated, the tokens are not valid after a restart (set JWT_PRIVATE_KEYS)", alg)
+		if rotation, err := time.ParseDuration(getenvs.GetEnvString("JWT_KEY_ROTATION", "0")); err == nil && rotation > 0 {
+			go func() {
+				for range time.Tick(rotation) {
+					if err := jwtKeys.rotate(l); err != nil {
+						l.Errorf("%s", err.Error())
+					}
+				}
+			}()
+		}
+	})
+}
+
+// jwtLoadKey reads a PEM private key (PKCS#8, PKCS#1 or SEC 1)
+func jwtLoadKey(file string) (*jwtKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key %T", key)
+	}
+	return newJWTKey(signer)
+}
+
+// jwtGenerateKey generates a key for the algorithm
+func jwtGenerateKey(alg string) (*jwtKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %s (RS256, ES256 or EdDSA)", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newJWTKey(signer)
+}
+
+// newJWTKey returns the key with the algorithm of its type
+func newJWTKey(signer crypto.Signer) (*jwtKey, error) {
+	k := &jwtKey{private: signer}
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		k.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			k.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			k.method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key %T", pub)
+	}
+	k.kid = k.jwk().thumbprint()
+	return k, nil
+}
+
+// jwk returns the public key in JWK format
+func (k *jwtKey) jwk() jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	j := jwk{Kid: k.kid, Use: "sig", Alg: k.method.Alg()}
+	switch pub := k.private.Public().(type) {
+	case *rsa.PublicKey:
+		j.Kty = "RSA"
+		j.N = b64(pub.N.Bytes())
+		j.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		j.Kty = "EC"
+		j.Crv = pub.Curve.Params().Name
+		j.X = b64(pub.X.FillBytes(make([]byte, size)))
+		j.Y = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		j.Kty = "OKP"
+		j.Crv = "Ed25519"
+		j.X = b64(pub)
+	}
+	return j
+}
+
+// thumbprint returns the SHA-256 of the required members of the JWK (RFC 7638)
+func (j jwk) thumbprint() string {
+	members := map[string]string{"kty": j.Kty}
+	switch j.Kty {
+	case "RSA":
+		members["n"], members["e"] = j.N, j.E
+	case "EC":
+		members["crv"], members["x"], members["y"] = j.Crv, j.X, j.Y
+	case "OKP":
+		members["crv"], members["x"] = j.Crv, j.X
+	}
+	// the keys of a map are sorted by encoding/json
+	content, _ := json.Marshal(members)
+	sum := sha256.Sum256(content)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jwtKeyRetention is the lifetime of the longest token, a retired key validates the tokens it signed until then
+func jwtKeyRetention() time.Duration {
+	retention := jwtTTL("JWT_ACCESS_TTL", "10m")
+	if refresh := jwtTTL("JWT_REFRESH_TTL", "24h"); refresh > retention {
+		retention = refresh
+	}
+	return retention
+}
+
+// rotate generates a new signing key, the previous keys are kept for the validation until the tokens
+// they signed are expired (jwtKeyRetention)
+func (r *jwtKeyRing) rotate(l *logger) error {
+	r.mu.RLock()
+	alg := r.alg
+	if len(r.keys) > 0 {
+		alg = r.keys[0].method.Alg()
+	}
+	r.mu.RUnlock()
+	if strings.HasPrefix(alg, "ES") {
+		alg = "ES256"
+	}
+	if alg == "HS256" {
+		return errJWTSymmetric
+	}
+	k, err := jwtGenerateKey(alg)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	retention := jwtKeyRetention()
+	r.mu.Lock()
+	keys := []*jwtKey{k}
+	for _, previous := range r.keys {
+		if previous.retired.IsZero() {
+			previous.retired = now
+		}
+		if now.Sub(previous.retired) > retention {
+			l.Infof("signing key %s removed, retired since %s", previous.kid, previous.retired.Format(time.RFC3339))
+			continue
+		}
+		keys = append(keys, previous)
+	}
+	r.keys = keys
+	r.mu.Unlock()
+	l.Infof("new %s signing key %s", alg, k.kid)
+	return nil
+}
+
+// signer returns the method, the key and the kid which sign the tokens (HS256 with MAGOVER_JWT_SECRET_KEY
+// when there is no asymmetric key)
+func (r *jwtKeyRing) signer() (jwt.SigningMethod, interface{}, string, error) {
+	initJWTKeys()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.keys) > 0 {
+		return r.keys[0].method, r.keys[0].private, r.keys[0].kid, nil
+	}
+	if r.alg != "HS256" {
+		return nil, nil, "", fmt.Errorf("no %s signing key", r.alg)
+	}
+	return jwt.SigningMethodHS256, key, "", nil
+}
+
+// verificationKey is the jwt.Keyfunc : the key of the kid, the algorithm of the token must be the one of the key,
+// HS256 (without kid) is accepted only without asymmetric keys
+func (r *jwtKeyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	initJWTKeys()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	kid, _ := token.Header["kid"].(string)
+	if len(kid) == 0 {
+		if token.Method != jwt.SigningMethodHS256 || r.alg != "HS256" || len(r.keys) > 0 {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return key, nil
+	}
+	for _, k := range r.keys {
+		if k.kid == kid {
+			if token.Method.Alg() != k.method.Alg() {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return k.private.Public(), nil
+		}
+	}
+	return nil, jwt.ErrSignatureInvalid
+}
+
+func (r *jwtKeyRing) jwks() jwks {
+	initJWTKeys()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	set := jwks{Keys: []jwk{}}
+	for _, k := range r.keys {
+		set.Keys = append(set.Keys, k.jwk())
+	}
+	return set
+}
+
+// ---- swagger Informations
+// @Tags         JWT
+// @router /.well-known/jwks.json [get]
+// @summary Public keys which validate the tokens (empty with HS256)
+// @produce application/json
+// @success 200 {object} jwks
+func jwksHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwtKeys.jwks())
+}
+
+// ---- swagger Informations
+// @Tags         Admin
+// @router /v1/admin/jwt/rotate [post]
+// @summary Generate a new signing key, the previous keys stay in the JWKS until the tokens they signed are expired
+// @security BearerAuth
+// @produce application/json
+// @success 200 {object} jwks
+// @failure 400 string Bad Request
+// @failure 401 string Unauthorized
+// @failure 403 string Forbidden
+// @failure 409 string Conflict (HS256)
+func jwtRotateHandler(c *gin.Context) {
+	if !jwtAdminAuthorized(c) {
+		return
+	}
+	initJWTKeys()
+	if err := jwtKeys.rotate(requestLogger(c, "JWT/KEYS")); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errJWTSymmetric) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, jwtKeys.jwks())
+}
+
+// function for Job
+func batchJobJWKS(argValues string) (interface{}, error) {
+	return jwtKeys.jwks(), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func TestJWTKeyRingRotate(t *testing.T) {
+	t.Setenv("JWT_ACCESS_TTL", "10m")
+	t.Setenv("JWT_REFRESH_TTL", "1h")
+	l := newLogger("TEST")
+	ring := &jwtKeyRing{alg: "ES256"}
+	if err := ring.rotate(l); err != nil {
+		t.Fatal(err)
+	}
+	first := ring.keys[0]
+	signed, err := jwt.NewWithClaims(first.method, jwt.RegisteredClaims{Subject: "alice"}).SignedString(first.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withKid := func(token *jwt.Token) (interface{}, error) {
+		token.Header["kid"] = first.kid
+		return ring.verificationKey(token)
+	}
+
+	// the rotations do not remove the keys which signed the live tokens
+	for i := 0; i < 5; i++ {
+		if err := ring.rotate(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ring.keys) != 6 || !ring.keys[0].retired.IsZero() || first.retired.IsZero() {
+		t.Fatalf("%d keys, 6 expected (signing key retired %v)", len(ring.keys), ring.keys[0].retired)
+	}
+	if _, err := jwt.Parse(signed, withKid); err != nil {
+		t.Fatalf("token of the first key not valid after the rotations: %v", err)
+	}
+
+	// the key retired before the longest lifetime (JWT_REFRESH_TTL) is removed
+	first.retired = time.Now().Add(-61 * time.Minute)
+	ring.keys[2].retired = time.Now().Add(-59 * time.Minute)
+	if err := ring.rotate(l); err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.keys) != 6 {
+		t.Fatalf("%d keys, 6 expected", len(ring.keys))
+	}
+	for _, k := range ring.keys {
+		if k == first {
+			t.Fatalf("the key %s retired since 61m is kept", first.kid)
+		}
+	}
+	if _, err := jwt.Parse(signed, withKid); err == nil {
+		t.Fatalf("token of the removed key still valid")
+	}
+}
+
+func TestJWTAdminAuthorized(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("JWT_USER_ROLES", "alice=admin,bob=reader")
+	t.Setenv("MACGOVER_ADMIN_TOKEN", "adm1n")
+	alice, err := jwtIssueTokens("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := jwtIssueTokens("bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		want   bool
+		status int
+	}{
+		{name: "anonymous", status: http.StatusUnauthorized},
+		{name: "wrong admin token", header: "Bearer adm1", status: http.StatusUnauthorized},
+		{name: "admin token", header: "Bearer adm1n", want: true},
+		{name: "admin role", header: "Bearer " + alice.AccessToken, want: true},
+		{name: "without admin role", header: "Bearer " + bob.AccessToken, status: http.StatusForbidden},
+		{name: "refresh token", header: "Bearer " + alice.RefreshToken, status: http.StatusUnauthorized},
+		{name: "cookie", cookie: alice.AccessToken, status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/admin/jwt/rotate", nil)
+			if len(test.header) > 0 {
+				c.Request.Header.Set("Authorization", test.header)
+			}
+			if len(test.cookie) > 0 {
+				c.Request.AddCookie(&http.Cookie{Name: "access_token", Value: test.cookie})
+			}
+			if got := jwtAdminAuthorized(c); got != test.want {
+				t.Fatalf("jwtAdminAuthorized = %v, %v expected", got, test.want)
+			}
+			if !test.want && w.Code != test.status {
+				t.Fatalf("status %d, %d expected", w.Code, test.status)
+			}
+		})
+	}
+}
+
+// HS256 (without kid) is accepted only with the secret and without asymmetric keys, the known default secret
+// of the previous versions is refused
+func TestJWTVerificationKeyHS256(t *testing.T) {
+	l := newLogger("TEST")
+	initJWTKeys()
+	if os.Getenv("MAGOVER_JWT_SECRET_KEY") == "" && (!jwtSecretGenerated || len(key) != 32 || string(key) == "james8ond") {
+		t.Fatalf("the secret is not generated without MAGOVER_JWT_SECRET_KEY")
+	}
+	sign := func(secret []byte, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, Token{Username: "mallory", Roles: []string{"admin"}})
+		if len(kid) > 0 {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	symmetric := &jwtKeyRing{alg: "HS256"}
+	asymmetric := &jwtKeyRing{alg: "ES256"}
+	if err := asymmetric.rotate(l); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		ring  *jwtKeyRing
+		token string
+		valid bool
+	}{
+		{"secret", symmetric, sign(key, ""), true},
+		{"known default secret", symmetric, sign([]byte("james8ond"), ""), false},
+		{"secret with a key ring", asymmetric, sign(key, ""), false},
+		{"secret with the kid of the key ring", asymmetric, sign(key, asymmetric.keys[0].kid), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := jwt.ParseWithClaims(test.token, &Token{}, test.ring.verificationKey)
+			if (err == nil) != test.valid {
+				t.Fatalf("error %v, valid %v expected", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestJWTRotateHandlerHS256(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("MACGOVER_ADMIN_TOKEN", "adm1n")
+	initJWTKeys()
+	saved := jwtKeys
+	jwtKeys = &jwtKeyRing{alg: "HS256"}
+	defer func() { jwtKeys = saved }()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/admin/jwt/rotate", nil)
+	c.Request.Header.Set("Authorization", "Bearer adm1n")
+	jwtRotateHandler(c)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "asymmetric") {
+		t.Fatalf("status %d %s, 409 expected", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- JWT access and refresh tokens
+
+const (
+	jwtAccessToken  = "access"
+	jwtRefreshToken = "refresh"
+)
+
+var (
+	// errJWTRevoked is returned when the jti of the token is in the deny list
+	errJWTRevoked = errors.New("token revoked")
+	// errJWTInvalid is returned when the issuer, the audience or the use of the token is wrong
+	errJWTInvalid = errors.New("invalid token")
+)
+
+// jwtTokenResponse is the response of /v1/jwt/login and /v1/jwt/refresh
+type jwtTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in,omitempty"`
+	IDToken          string `json:"id_token,omitempty"` // OIDC
+	Scope            string `json:"scope,omitempty"`    // OIDC
+}
+
+// jwtTTL reads a lifetime (ex 10m, 24h)
+func jwtTTL(name string, defaultValue string) time.Duration {
+	ttl, err := time.ParseDuration(getenvs.GetEnvString(name, defaultValue))
+	if err != nil {
+		ttl, _ = time.ParseDuration(defaultValue)
+	}
+	return ttl
+}
+
+func jwtIssuer() string {
+	return getenvs.GetEnvString("JWT_ISSUER", "macgover")
+}
+
+func jwtAudience() string {
+	return getenvs.GetEnvString("JWT_AUDIENCE", "macgover")
+}
+
+// jwtNewID returns a random jti
+func jwtNewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// jwtNewClaims returns the claims of a token of the user
+func jwtNewClaims(username string, use string, now time.Time, ttl time.Duration) Token {
+	return Token{
+		Username: username,
+		TokenUse: use,
+		Roles:    jwtUserClaims("JWT_USER_ROLES", username),
+		Scope:    strings.Join(jwtUserClaims("JWT_USER_SCOPES", username), " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer(),
+			Subject:   username,
+			Audience:  jwt.ClaimStrings{jwtAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jwtNewID(),
+		},
+	}
+}
+
+// jwtIssueTokens signs an access token (JWT_ACCESS_TTL, default 10m) and a refresh token
+// (JWT_REFRESH_TTL, default 24h, 0 to disable the refresh tokens), the claims are completed by complete
+// when it is not nil (ex scope and client_id of the OIDC tokens)
+func jwtIssueTokens(username string, complete func(claims *Token)) (*jwtTokenResponse, error) {
+	now := time.Now()
+	accessTTL := jwtTTL("JWT_ACCESS_TTL", "10m")
+	claims := jwtNewClaims(username, jwtAccessToken, now, accessTTL)
+	if complete != nil {
+		complete(&claims)
+	}
+	access, err := jwtSign(claims)
+	if err != nil {
+		return nil, err
+	}
+	tokens := &jwtTokenResponse{AccessToken: access, TokenType: "Bearer", ExpiresIn: int64(accessTTL.Seconds())}
+
+	refreshTTL := jwtTTL("JWT_REFRESH_TTL", "24h")
+	if refreshTTL > 0 {
+		claims := jwtNewClaims(username, jwtRefreshToken, now, refreshTTL)
+		if complete != nil {
+			complete(&claims)
+		}
+		refresh, err := jwtSign(claims)
+		if err != nil {
+			return nil, err
+		}
+		tokens.RefreshToken = refresh
+		tokens.RefreshExpiresIn = int64(refreshTTL.Seconds())
+	}
+	return tokens, nil
+}
+
+// jwtParseToken validates the signature, the dates, the issuer, the audience, the use (any use when empty)
+// and checks the deny list
+func jwtParseToken(tokenString string, use string) (*jwt.Token, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Token{}, jwtKeys.verificationKey)
+	if err != nil {
+		return token, err
+	}
+	claims := token.Claims.(*Token)
+	issuer := jwtIssuer()
+	if len(claims.ClientID) > 0 {
+		// the tokens of the OIDC provider have the issuer of the provider
+		if oidc, err := oidcIssuer(); err == nil {
+			issuer = oidc
+		}
+	}
+	if !claims.VerifyIssuer(issuer, true) || !claims.VerifyAudience(jwtAudience(), true) {
+		token.Valid = false
+		return token, fmt.Errorf("%w (issuer or audience)", errJWTInvalid)
+	}
+	if len(use) > 0 && claims.TokenUse != use {
+		token.Valid = false
+		return token, fmt.Errorf("%w (%s expected)", errJWTInvalid, use)
+	}
+	revoked, err := jwtDenied.isRevoked(claims.ID)
+	if err != nil {
+		token.Valid = false
+		return token, err
+	}
+	if revoked {
+		token.Valid = false
+		return token, errJWTRevoked
+	}
+	return token, nil
+}
+
+// --------------------------- deny list
+
+// jwtDenyList contains the jti of the revoked tokens until their expiration, in memory and in the database
+// target JWT_DENYLIST_DB_TARGET (shared by the instances) when it is set
+type jwtDenyList struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+var jwtDenied = &jwtDenyList{entries: map[string]time.Time{}}
+
+// jwtDenyListTable returns the target and the table of the deny list (nil without JWT_DENYLIST_DB_TARGET)
+func jwtDenyListTable() (*dbTarget, string, error) {
+	name := os.Getenv("JWT_DENYLIST_DB_TARGET")
+	if len(name) == 0 {
+		return nil, "", nil
+	}
+	t, err := getDBTarget(name)
+	if err != nil {
+		return nil, "", err
+	}
+	table := getenvs.GetEnvString("JWT_DENYLIST_TABLE", "jwt_denylist")
+	if err := validateDBIdentifier(table); err != nil {
+		return nil, "", err
+	}
+	return t, table, nil
+}
+
+func (d *jwtDenyList) revoke(jti string, expiration time.Time, l *logger) error {
+	err := d.revokeIfAbsent(jti, expiration, l)
+	if errors.Is(err, errJWTRevoked) {
+		return nil
+	}
+	return err
+}
+
+// revokeIfAbsent adds the jti to the deny list and returns errJWTRevoked when it is already there, the check
+// and the insert are atomic in memory and in the database (jti is the primary key of the table) so a token
+// used once (refresh) cannot be replayed by concurrent requests
+func (d *jwtDenyList) revokeIfAbsent(jti string, expiration time.Time, l *logger) error {
+	now := time.Now()
+	d.mu.Lock()
+	for id, exp := range d.entries {
+		if now.After(exp) {
+			delete(d.entries, id)
+		}
+	}
+	if _, ok := d.entries[jti]; ok {
+		d.mu.Unlock()
+		return errJWTRevoked
+	}
+	d.entries[jti] = expiration
+	d.mu.Unlock()
+
+	t, table, err := jwtDenyListTable()
+	if err != nil || t == nil {
+		return err
+	}
+	if _, err := t.db.Exec(dbRebind(t.engine, "DELETE FROM "+table+" WHERE expires_at < ?"), now.Unix()); err != nil {
+		l.Errorf("deny list : %s", err.Error())
+	}
+	if _, err := t.db.Exec(dbRebind(t.engine, "INSERT INTO "+table+" (jti, expires_at) VALUES (?, ?)"), jti, expiration.Unix()); err != nil {
+		if t.engine.duplicateKey != nil && t.engine.duplicateKey(err) {
+			return errJWTRevoked
+		}
+		l.Errorf("deny list : %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (d *jwtDenyList) isRevoked(jti string) (bool, error) {
+	d.mu.Lock()
+	_, ok := d.entries[jti]
+	d.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+
+	t, table, err := jwtDenyListTable()
+	if err != nil || t == nil {
+		return false, err
+	}
+	var count int
+	if err := t.db.QueryRow(dbRebind(t.engine, "SELECT COUNT(*) FROM "+table+" WHERE jti = ?"), jti).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ---- swagger Informations
+// @Tags         JWT
+// @router /v1/jwt/refresh [post]
+// @summary Exchange a refresh token for new access and refresh tokens (the refresh token is used once)
+// @consume application/json
+// @param data body object true "{\"refresh_token\": \"...\"}"
+// @produce application/json
+// @success 200 {object} jwtTokenResponse
+// @failure 400 string Bad Request
+// @failure 401 string Unauthorized
+// @failure 500 string Internal Server Error
+func jwtRefreshHandler(c *gin.Context) {
+	l := requestLogger(c, "JWT/REFRESH")
+	var data struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || len(data.RefreshToken) == 0 {
+		c.String(http.StatusBadRequest, "refresh_token is required")
+		return
+	}
+	token, err := jwtParseToken(data.RefreshToken, jwtRefreshToken)
+	if err != nil || !token.Valid {
+		l.Warnf("refresh refused, %v", err)
+		c.Writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	claims := token.Claims.(*Token)
+	if err := jwtDenied.revokeIfAbsent(claims.ID, claims.ExpiresAt.Time, l); errors.Is(err, errJWTRevoked) {
+		l.Warnf("refresh refused, the refresh token %s of %s is already used", claims.ID, claims.Username)
+		c.Writer.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		c.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tokens, err := jwtIssueTokens(claims.Username, nil)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		c.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	l.Infof("tokens of %s refreshed", claims.Username)
+	c.JSON(http.StatusOK, tokens)
+}
+
+// ---- swagger Informations
+// @Tags         JWT
+// @router /v1/jwt/revoke [post]
+// @summary Revoke (logout) the bearer token and/or the token of the body until their expiration
+// @security BearerAuth
+// @consume application/json
+// @param data body object false "{\"token\": \"...\"}"
+// @produce application/json
+// @success 200 string OK
+// @failure 400 string Bad Request
+// @failure 401 string Unauthorized
+// @failure 500 string Internal Server Error
+func jwtRevokeHandler(c *gin.Context) {
+	l := requestLogger(c, "JWT/REVOKE")
+	var data struct {
+		Token string `json:"token"`
+	}
+	c.ShouldBindJSON(&data)
+	tokens := []string{}
+	if len(data.Token) > 0 {
+		tokens = append(tokens, data.Token)
+	}
+	if bearer, err := jwtHeaderToken(c.GetHeader("Authorization")); err == nil {
+		tokens = append(tokens, bearer)
+	}
+	if len(tokens) == 0 {
+		c.String(http.StatusBadRequest, "token is required")
+		return
+	}
+
+	revoked := []string{}
+	for _, tokenString := range tokens {
+		token, err := jwtParseToken(tokenString, "")
+		if errors.Is(err, errJWTRevoked) || errors.Is(err, jwt.ErrTokenExpired) {
+			// nothing to revoke
+			continue
+		}
+		if err != nil || !token.Valid {
+			l.Warnf("revocation refused, %v", err)
+			c.Writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims := token.Claims.(*Token)
+		if err := jwtDenied.revoke(claims.ID, claims.ExpiresAt.Time, l); err != nil {
+			c.Writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		l.Infof("%s token %s of %s revoked", claims.TokenUse, claims.ID, claims.Username)
+		revoked = append(revoked, claims.ID)
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
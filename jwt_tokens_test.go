@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// concurrent replays of one refresh token: only one request gets new tokens
+func TestJWTRefreshSingleUse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens, err := jwtIssueTokens("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"refresh_token":"` + tokens.RefreshToken + `"}`
+
+	const replays = 50
+	codes := make(chan int, replays)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < replays; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/jwt/refresh", strings.NewReader(body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			jwtRefreshHandler(c)
+			codes <- c.Writer.Status()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(codes)
+
+	count := map[int]int{}
+	for code := range codes {
+		count[code]++
+	}
+	if count[http.StatusOK] != 1 || count[http.StatusUnauthorized] != replays-1 {
+		t.Fatalf("status codes %v, one %d expected", count, http.StatusOK)
+	}
+}
+
+// two instances share the deny list of the database, the primary key refuses the second use
+func TestJWTDenyListTable(t *testing.T) {
+	e, err := getDBEngine("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(e.Driver, "file:"+filepath.Join(t.TempDir(), "denylist.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE jwt_denylist (jti VARCHAR(64) PRIMARY KEY, expires_at BIGINT)"); err != nil {
+		t.Fatal(err)
+	}
+	initDBTargets()
+	dbTargets["denylist-test"] = &dbTarget{Name: "denylist-test", engine: e, db: db}
+	defer delete(dbTargets, "denylist-test")
+	t.Setenv("JWT_DENYLIST_DB_TARGET", "denylist-test")
+
+	l := newLogger("TEST")
+	expiration := time.Now().Add(time.Hour)
+	first := &jwtDenyList{entries: map[string]time.Time{}}
+	second := &jwtDenyList{entries: map[string]time.Time{}}
+
+	if err := first.revokeIfAbsent("jti-1", expiration, l); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := first.revokeIfAbsent("jti-1", expiration, l); !errors.Is(err, errJWTRevoked) {
+		t.Fatalf("reuse on the same instance: %v, %v expected", err, errJWTRevoked)
+	}
+	if err := second.revokeIfAbsent("jti-1", expiration, l); !errors.Is(err, errJWTRevoked) {
+		t.Fatalf("reuse on another instance: %v, %v expected", err, errJWTRevoked)
+	}
+	if revoked, err := second.isRevoked("jti-1"); err != nil || !revoked {
+		t.Fatalf("isRevoked = %v, %v", revoked, err)
+	}
+	// revoke (logout) of a token already revoked is not an error
+	if err := second.revoke("jti-1", expiration, l); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := second.revokeIfAbsent("jti-2", expiration, l); err != nil {
+		t.Fatalf("another token: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+	getenvs "gitlab.com/avarf/getenvs"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// --------------------------- JWT users
+
+// jwtDemoUsers is used when JWT_USERS is not set
+const jwtDemoUsers = "jwtuser1:{PLAIN}pa$$W0rd1"
+
+// errJWTPasswordFormat is returned when the stored password has an unknown scheme, or has no scheme
+// without JWT_PLAIN_PASSWORDS
+var errJWTPasswordFormat = errors.New("unsupported password format")
+
+// jwtPasswordSchemeRegexp matches the scheme of a stored password : $id$ (crypt, ex $apr1$, $6$, $argon2id$) or {SCHEME}
+var jwtPasswordSchemeRegexp = regexp.MustCompile(`^(\$[A-Za-z0-9._-]+\$|\{[A-Za-z0-9._-]+\})`)
+
+var jwtDemoUsersOnce sync.Once
+
+// jwtUserStore checks the credentials of the users who ask for a token
+type jwtUserStore interface {
+	// authenticate returns errJWTUnauthorized when the user or the password is wrong
+	authenticate(username string, password string, l *logger) error
+}
+
+// jwtUserStoreFromEnv returns the store of JWT_USER_STORE : env (default), file, ldap or sql
+func jwtUserStoreFromEnv() (jwtUserStore, error) {
+	switch store := strings.ToLower(getenvs.GetEnvString("JWT_USER_STORE", "env")); store {
+	case "env":
+		return jwtEnvStore{}, nil
+	case "file":
+		file := os.Getenv("JWT_USERS_FILE")
+		if len(file) == 0 {
+			return nil, errors.New("JWT_USERS_FILE is required with JWT_USER_STORE=file")
+		}
+		return jwtFileStore{file: file}, nil
+	case "ldap":
+		return jwtLDAPStore{}, nil
+	case "sql":
+		return jwtSQLStore{
+			target: os.Getenv("JWT_USERS_DB_TARGET"),
+			engine: os.Getenv("JWT_USERS_DB_ENGINE"),
+			query:  getenvs.GetEnvString("JWT_USERS_QUERY", "SELECT password FROM users WHERE username = ?"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown JWT_USER_STORE %s (env, file, ldap or sql)", store)
+	}
+}
+
+// jwtAuthenticate checks the credentials with the store of JWT_USER_STORE
+func jwtAuthenticate(username string, password string, l *logger) error {
+	if len(username) == 0 || len(password) == 0 {
+		return errJWTUnauthorized
+	}
+	store, err := jwtUserStoreFromEnv()
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return err
+	}
+	if err := store.authenticate(username, password, l); err != nil {
+		if errors.Is(err, errJWTUnauthorized) {
+			l.Warnf("authentication failed for %s", username)
+		}
+		return err
+	}
+	l.Infof("%s authenticated", username)
+	return nil
+}
+
+var (
+	// jwtDummyHash is compared when the user is unknown, the response time does not reveal the users
+	jwtDummyHash     []byte
+	jwtDummyHashOnce sync.Once
+)
+
+// jwtCheckPassword compares the password with the stored hash in constant time : bcrypt ($2a$, $2b$, $2y$),
+// {SHA} (htpasswd SHA-1) or {PLAIN} (plain text), a value without scheme is plain text only with JWT_PLAIN_PASSWORDS=true
+// and the other schemes are refused (errJWTPasswordFormat)
+func jwtCheckPassword(hash string, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1, nil
+	case strings.HasPrefix(hash, "{PLAIN}"):
+		return jwtComparePlain(hash[len("{PLAIN}"):], password), nil
+	}
+	if scheme := jwtPasswordSchemeRegexp.FindString(hash); len(scheme) > 0 {
+		return false, fmt.Errorf("%w: %s (bcrypt, {SHA} or {PLAIN} expected)", errJWTPasswordFormat, scheme)
+	}
+	if plain, _ := getenvs.GetEnvBool("JWT_PLAIN_PASSWORDS", false); !plain {
+		return false, fmt.Errorf("%w: no scheme (bcrypt, {SHA} or {PLAIN} expected, or JWT_PLAIN_PASSWORDS=true)", errJWTPasswordFormat)
+	}
+	return jwtComparePlain(hash, password), nil
+}
+
+// jwtComparePlain compares the sums of the passwords, they have the same length and the comparison
+// does not reveal the length of the password
+func jwtComparePlain(expected string, password string) bool {
+	expectedSum := sha256.Sum256([]byte(expected))
+	actualSum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(expectedSum[:], actualSum[:]) == 1
+}
+
+// jwtCheckUser checks the password of the user in the users (username -> hash), a password
+// with an unsupported format is logged and refused
+func jwtCheckUser(users map[string]string, username string, password string, l *logger) error {
+	hash, ok := users[username]
+	if !ok {
+		jwtDummyHashOnce.Do(func() {
+			jwtDummyHash, _ = bcrypt.GenerateFromPassword([]byte("macgover"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(jwtDummyHash, []byte(password))
+		return errJWTUnauthorized
+	}
+	ok, err := jwtCheckPassword(hash, password)
+	if err != nil {
+		l.Errorf("the user %s is refused, %s", username, err.Error())
+		return errJWTUnauthorized
+	}
+	if !ok {
+		return errJWTUnauthorized
+	}
+	return nil
+}
+
+// jwtEnvStore reads the users in JWT_USERS (user1:hash1,user2:hash2)
+type jwtEnvStore struct{}
+
+func (jwtEnvStore) authenticate(username string, password string, l *logger) error {
+	value, ok := os.LookupEnv("JWT_USERS")
+	if !ok {
+		jwtDemoUsersOnce.Do(func() { l.Warnf("JWT_USERS is not set, the demo user jwtuser1 is used") })
+		value = jwtDemoUsers
+	}
+	users := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) == 2 {
+			users[parts[0]] = parts[1]
+		}
+	}
+	return jwtCheckUser(users, username, password, l)
+}
+
+// jwtFileStore reads the users in JWT_USERS_FILE, a htpasswd file (user:hash)
+// or a YAML file (.yaml, .yml) with a map of the users :
+//
+//	users:
+//	  jwtuser1: $2y$10$...
+type jwtFileStore struct {
+	file string
+}
+
+func (s jwtFileStore) authenticate(username string, password string, l *logger) error {
+	l.Debugf("JWT_USERS_FILE=%s", s.file)
+	f, err := os.Open(s.file)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	switch strings.ToLower(filepath.Ext(s.file)) {
+	case ".yaml", ".yml":
+		var content struct {
+			Users map[string]string `yaml:"users"`
+		}
+		if err := yaml.NewDecoder(f).Decode(&content); err != nil {
+			l.Errorf("%s : %s", s.file, err.Error())
+			return err
+		}
+		users = content.Users
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) == 2 {
+				users[parts[0]] = parts[1]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			l.Errorf("%s : %s", s.file, err.Error())
+			return err
+		}
+	}
+	return jwtCheckUser(users, username, password, l)
+}
+
+// jwtLDAPStore binds to the ldap with the user (same variables as /v1/ldap, LDAP_AUTH_GROUP is required when it is set)
+type jwtLDAPStore struct{}
+
+func (jwtLDAPStore) authenticate(username string, password string, l *logger) error {
+	member, err := ldapAuthenticate(username, password, l)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return errJWTUnauthorized
+	}
+	if err != nil {
+		return err
+	}
+	if !member {
+		return errJWTUnauthorized
+	}
+	return nil
+}
+
+// jwtSQLStore reads the hash of the password with JWT_USERS_QUERY, in the database target JWT_USERS_DB_TARGET
+// or in the database JWT_USERS_DB_ENGINE (DB_* variables)
+type jwtSQLStore struct {
+	target string
+	engine string
+	query  string
+}
+
+func (s jwtSQLStore) authenticate(username string, password string, l *logger) error {
+	var db *sql.DB
+	var e *dbEngine
+	switch {
+	case len(s.target) > 0:
+		t, err := getDBTarget(s.target)
+		if err != nil {
+			l.Errorf("%s", err.Error())
+			return err
+		}
+		db, e = t.db, t.engine
+	case len(s.engine) > 0:
+		var err error
+		if e, err = getDBEngine(s.engine); err != nil {
+			l.Errorf("%s", err.Error())
+			return err
+		}
+		if db, err = DBsqlconnect(s.engine, l); err != nil {
+			return err
+		}
+		defer db.Close()
+	default:
+		return errors.New("JWT_USERS_DB_TARGET or JWT_USERS_DB_ENGINE is required with JWT_USER_STORE=sql")
+	}
+
+	var hash string
+	query := dbRebind(e, s.query)
+	l.Debugf("JWT_USERS_QUERY=%s", query)
+	err := db.QueryRow(query, username).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return jwtCheckUser(nil, username, password, l)
+	}
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return err
+	}
+	return jwtCheckUser(map[string]string{username: hash}, username, password, l)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestJWTCheckPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		plain    string // JWT_PLAIN_PASSWORDS
+		want     bool
+		err      bool
+	}{
+		{name: "bcrypt", hash: string(bcryptHash), password: "secret", want: true},
+		{name: "bcrypt wrong", hash: string(bcryptHash), password: "wrong"},
+		{name: "bcrypt 2y", hash: "$2y$" + string(bcryptHash)[4:], password: "secret", want: true},
+		{name: "bcrypt hash as password", hash: string(bcryptHash), password: string(bcryptHash)},
+		{name: "sha", hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "secret", want: true},
+		{name: "sha wrong", hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "wrong"},
+		{name: "plain", hash: "{PLAIN}secret", password: "secret", want: true},
+		{name: "plain wrong", hash: "{PLAIN}secret", password: "secre"},
+		{name: "plain with prefix as password", hash: "{PLAIN}secret", password: "{PLAIN}secret"},
+		{name: "plain dollars", hash: "{PLAIN}pa$$W0rd1", password: "pa$$W0rd1", want: true},
+		// the stored value must not log the user in
+		{name: "apr1", hash: "$apr1$salt$hash", password: "$apr1$salt$hash", err: true},
+		{name: "sha512 crypt", hash: "$6$salt$hash", password: "$6$salt$hash", err: true},
+		{name: "sha256 crypt", hash: "$5$rounds=5000$salt$hash", password: "$5$rounds=5000$salt$hash", err: true},
+		{name: "argon2", hash: "$argon2id$v=19$m=65536,t=3,p=4$salt$hash", password: "$argon2id$v=19$m=65536,t=3,p=4$salt$hash", err: true},
+		{name: "ssha", hash: "{SSHA}aGFzaHNhbHQ=", password: "{SSHA}aGFzaHNhbHQ=", err: true},
+		{name: "crypt", hash: "{CRYPT}abc", password: "{CRYPT}abc", err: true},
+		{name: "unknown scheme with opt-in", hash: "$6$salt$hash", password: "$6$salt$hash", plain: "true", err: true},
+		{name: "no scheme", hash: "secret", password: "secret", err: true},
+		{name: "no scheme with opt-in", hash: "secret", password: "secret", plain: "true", want: true},
+		{name: "no scheme with opt-in wrong", hash: "secret", password: "wrong", plain: "true"},
+		{name: "dollar inside with opt-in", hash: "pa$$W0rd1", password: "pa$$W0rd1", plain: "true", want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("JWT_PLAIN_PASSWORDS", test.plain)
+			got, err := jwtCheckPassword(test.hash, test.password)
+			if test.err != (err != nil) {
+				t.Fatalf("error %v, error expected %v", err, test.err)
+			}
+			if err != nil && !errors.Is(err, errJWTPasswordFormat) {
+				t.Fatalf("error %v, errJWTPasswordFormat expected", err)
+			}
+			if got != test.want {
+				t.Fatalf("jwtCheckPassword(%q, %q) = %v, %v expected", test.hash, test.password, got, test.want)
+			}
+		})
+	}
+}
+
+func TestJWTEnvStore(t *testing.T) {
+	t.Setenv("JWT_USERS", "alice:{PLAIN}secret,bob:$apr1$salt$hash,carol:plain")
+	tests := []struct {
+		username string
+		password string
+		err      error
+	}{
+		{"alice", "secret", nil},
+		{"alice", "wrong", errJWTUnauthorized},
+		{"bob", "$apr1$salt$hash", errJWTUnauthorized},
+		{"carol", "plain", errJWTUnauthorized},
+		{"unknown", "secret", errJWTUnauthorized},
+	}
+	l := newLogger("TEST")
+	for _, test := range tests {
+		if err := (jwtEnvStore{}).authenticate(test.username, test.password, l); !errors.Is(err, test.err) {
+			t.Errorf("authenticate(%s, %s) = %v, %v expected", test.username, test.password, err, test.err)
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"crypto/tls"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	//"regexp"
@@ -10,48 +10,190 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-ldap/ldap/v3"
+	getenvs "gitlab.com/avarf/getenvs"
 )
 
+// errLDAPConfig is a configuration error (bind mode, service account), not a user error
+var errLDAPConfig = errors.New("LDAP configuration error")
+
+func init() {
+	registerBatchJob("ldap", "connect and bind to LDAP_URL", `{"username": "user", "password": "secret"}`, batchJobLDAP)
+}
+
 // ---- swagger Informations
 // @Tags         Endpoints
 // @router /v1/ldap [get]
 // @summary LDAP connection and blind test
 // @security BasicAuth
 // @produce text/plain
+// @param format query string false "text (default) or json"
 // @success 200 string OK
 // @failure 401 string Unauthorized
 // @failure 500 string Internal Server Error
 func ldapHandler(c *gin.Context) {
 	username, password, ok := c.Request.BasicAuth()
 	if !ok {
-		c.Writer.Header().Add("WWW-Authenticate", `Basic realm="Macgover", charset="UTF-8" `)
-		c.Writer.WriteHeader(http.StatusUnauthorized)
+		ldapUnauthorized(c)
 		return
 	}
-	log.Printf("[LDAP] INFO : login=" + username)
-	
-	ldapBindDN := os.Getenv("LDAP_BIND_DN")
-	username = "cn=" + strings.ToLower(username) + "," + ldapBindDN
-	log.Printf("[LDAP] INFO : BindDN=" + username)
+	conn, _, err := ldapBindConn(username, password, requestLogger(c, "LDAP"))
+	if err != nil {
+		ldapErrorResponse(c, err)
+		return
+	}
+	defer conn.Close()
 
-	ldapURL := os.Getenv("LDAP_URL")
-	log.Printf("[LDAP] INFO : LDAP_URL=" + ldapURL)
+	// with TLS (ldaps:// or StartTLS), the version, the cipher and the certificates of the server are displayed
+	tlsReport := ldapTLSReport(conn)
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, gin.H{"username": username, "bind": "OK", "tls": tlsReport})
+		return
+	}
+	msg := "LDAP Connection and Bind are OK"
+	if tlsReport != nil {
+		msg += "\n" + tlsReport.String()
+	}
+	c.String(http.StatusOK, msg)
+}
 
-	l, err := ldap.DialURL(ldapURL, ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
-	defer l.Close()
+// ldapUnauthorized asks for a Basic authentication
+func ldapUnauthorized(c *gin.Context) {
+	c.Writer.Header().Add("WWW-Authenticate", `Basic realm="Macgover", charset="UTF-8" `)
+	c.Writer.WriteHeader(http.StatusUnauthorized)
+}
 
-	if err != nil {
-		log.Printf("[LDAP] ERROR : Dial=" + err.Error())
+// ldapErrorResponse returns 500 when the server is not reachable or misconfigured, 401 otherwise
+func ldapErrorResponse(c *gin.Context, err error) {
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || errors.Is(err, errLDAPConfig) {
 		c.Writer.WriteHeader(http.StatusInternalServerError)
 		return
-	} else {
-		err := l.Bind(strings.ToLower(username), password)
-		if err != nil {
-			log.Printf("[LDAP] ERROR : Bind=" + err.Error())
-			c.Writer.Header().Add("WWW-Authenticate", `Basic realm="Macgover", charset="UTF-8" `)
-			c.Writer.WriteHeader(http.StatusUnauthorized)
-			return
+	}
+	ldapUnauthorized(c)
+}
+
+// ldapBindConn connects to LDAP_URL and binds with the user, it returns the name used to bind
+// (DN, UPN ...), the connection must be closed by the caller
+func ldapBindConn(username string, password string, l *logger) (*ldap.Conn, string, error) {
+	l.Infof("login=%s", username)
+
+	bindDN, err := ldapUserDN(username, l)
+	if err != nil {
+		return nil, "", err
+	}
+	l.Debugf("BindDN=%s", bindDN)
+
+	conn, _, err := ldapConnect(l)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = conn.Bind(bindDN, password)
+	if err != nil {
+		l.Errorf("Bind=%s", err.Error())
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, bindDN, nil
+}
+
+// ldapUserDN returns the name used to bind the user (LDAP_BIND_MODE) :
+//   - template (default) : LDAP_BIND_DN_TEMPLATE with {username} replaced, ex uid={username},ou=people,dc=example,dc=org,
+//     {username}@example.org (Active Directory UPN) or EXAMPLE\{username}
+//   - search : the service account (LDAP_SERVICE_DN) searches the DN of the user with LDAP_USER_FILTER
+func ldapUserDN(username string, l *logger) (string, error) {
+	mode := strings.ToLower(getenvs.GetEnvString("LDAP_BIND_MODE", "template"))
+	switch mode {
+	case "template":
+		return ldapTemplateDN(getenvs.GetEnvString("LDAP_BIND_DN_TEMPLATE", "cn={username},"+os.Getenv("LDAP_BIND_DN")), username), nil
+	case "search":
+		return ldapSearchUserDN(username, l)
+	}
+	l.Errorf("unknown LDAP_BIND_MODE %s", mode)
+	return "", fmt.Errorf("%w: unknown LDAP_BIND_MODE %s (template or search)", errLDAPConfig, mode)
+}
+
+// ldapTemplateDN replaces {username} in the template, the username is escaped when the template is a DN
+func ldapTemplateDN(template string, username string) string {
+	if !strings.Contains(template, "=") {
+		return strings.ReplaceAll(template, "{username}", username)
+	}
+	return strings.ReplaceAll(template, "{username}", ldapEscapeDN(username))
+}
+
+// ldapEscapeDN escapes a value of a DN (RFC 4514)
+func ldapEscapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`\,+"<>;=`, r),
+			r == '#' && i == 0,
+			r == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteRune('\\')
 		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ldapSearchUserDN searches the user in LDAP_USER_BASE with LDAP_USER_FILTER, with a connection
+// of the service account (LDAP_SERVICE_DN, LDAP_SERVICE_PASSWORD)
+func ldapSearchUserDN(username string, l *logger) (string, error) {
+	var dn string
+	err := ldapWithServiceAccount(l, func(conn *ldap.Conn) error {
+		entry, err := ldapFindUser(conn, username, []string{"dn"}, l)
+		if err == nil {
+			dn = entry.DN
+		}
+		return err
+	})
+	return dn, err
+}
+
+// ldapUserFilter returns LDAP_USER_FILTER with {username} replaced by the escaped username (RFC 4515)
+func ldapUserFilter(username string) string {
+	return strings.ReplaceAll(getenvs.GetEnvString("LDAP_USER_FILTER", "(|(uid={username})(sAMAccountName={username})(userPrincipalName={username}))"),
+		"{username}", ldap.EscapeFilter(username))
+}
+
+// ldapFindUser searches the entry of the user in LDAP_USER_BASE with LDAP_USER_FILTER
+func ldapFindUser(conn *ldap.Conn, username string, attributes []string, l *logger) (*ldap.Entry, error) {
+	base := getenvs.GetEnvString("LDAP_USER_BASE", getenvs.GetEnvString("LDAP_SEARCH_BASE", os.Getenv("LDAP_BIND_DN")))
+	filter := ldapUserFilter(username)
+	l.Debugf("search user base=%s filter=%s", base, filter)
+
+	request := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false, filter, attributes, nil)
+	sr, err := conn.Search(request)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		l.Errorf("Search user=%s", err.Error())
+		return nil, fmt.Errorf("%w: search user : %s", errLDAPConfig, err.Error())
+	}
+	if sr == nil || len(sr.Entries) != 1 {
+		count := 0
+		if sr != nil {
+			count = len(sr.Entries)
+		}
+		l.Errorf("Search user=%d entries found for %s", count, username)
+		return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("%d entries found for the user %s", count, username))
+	}
+	return sr.Entries[0], nil
+}
+
+// function for Job
+func batchJobLDAP(argValues string) (interface{}, error) {
+	var data struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Username) == 0 {
+		return nil, fmt.Errorf("%w: username is required", errBatchArgument)
+	}
+	conn, _, err := ldapBindConn(data.Username, data.Password, newLogger("BATCH/LDAP"))
+	if err != nil {
+		return nil, err
 	}
-	c.String(http.StatusOK, "LDAP Connection and Bind are OK")
+	defer conn.Close()
+	return gin.H{"username": data.Username, "bind": "OK", "tls": ldapTLSReport(conn)}, nil
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- LDAP authentication of the routes
+
+// ldapAuthUserKey is the key of the authenticated user in the gin context
+const ldapAuthUserKey = "ldap_user"
+
+// ldapAuthCache keeps the successful authentications during LDAP_AUTH_CACHE_TTL, the credentials are
+// hashed with a HMAC-SHA256 and a random key generated at startup (the keys of a memory dump can't be brute-forced)
+var ldapAuthCache = newLDAPCredentialCache()
+
+type ldapCredentialCache struct {
+	mu      sync.Mutex
+	secret  []byte
+	entries map[string]time.Time // HMAC of the credentials -> expiration
+}
+
+func newLDAPCredentialCache() *ldapCredentialCache {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &ldapCredentialCache{secret: secret, entries: map[string]time.Time{}}
+}
+
+func (cc *ldapCredentialCache) key(username string, password string) string {
+	mac := hmac.New(sha256.New, cc.secret)
+	mac.Write([]byte(username + "\x00" + password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cc *ldapCredentialCache) valid(username string, password string) bool {
+	key := cc.key(username, password)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	expiration, ok := cc.entries[key]
+	if ok && time.Now().After(expiration) {
+		delete(cc.entries, key)
+		return false
+	}
+	return ok
+}
+
+func (cc *ldapCredentialCache) add(username string, password string, ttl time.Duration) {
+	now := time.Now()
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for key, expiration := range cc.entries {
+		if now.After(expiration) {
+			delete(cc.entries, key)
+		}
+	}
+	cc.entries[cc.key(username, password)] = now.Add(ttl)
+}
+
+// ldapAuthenticate binds with the user, and checks the membership of LDAP_AUTH_GROUP when it is set
+func ldapAuthenticate(username string, password string, l *logger) (bool, error) {
+	group := os.Getenv("LDAP_AUTH_GROUP")
+	if len(group) > 0 {
+		result, err := ldapUserGroups(username, password, group, l)
+		if err != nil {
+			return false, err
+		}
+		return *result.Member, nil
+	}
+	conn, _, err := ldapBindConn(username, password, l)
+	if err != nil {
+		return false, err
+	}
+	conn.Close()
+	return true, nil
+}
+
+// ldapAuth returns a middleware which requires a LDAP Basic authentication when the group of routes
+// is in LDAP_AUTH_ROUTES, the successful authentications are cached during LDAP_AUTH_CACHE_TTL (default 60s, 0 to disable)
+func ldapAuth(routes string) gin.HandlerFunc {
+	if !authRouteEnabled("LDAP_AUTH_ROUTES", routes) {
+		return func(c *gin.Context) { c.Next() }
+	}
+	newLogger("LDAP/AUTH").Infof("the routes %s require a LDAP authentication", routes)
+
+	return func(c *gin.Context) {
+		l := requestLogger(c, "LDAP/AUTH")
+		username, password, ok := c.Request.BasicAuth()
+		if !ok || len(password) == 0 {
+			ldapUnauthorized(c)
+			c.Abort()
+			return
+		}
+		ttl, err := time.ParseDuration(getenvs.GetEnvString("LDAP_AUTH_CACHE_TTL", "60s"))
+		if err != nil {
+			ttl = 60 * time.Second
+		}
+		if ttl > 0 && ldapAuthCache.valid(username, password) {
+			l.Debugf("%s authenticated (cache)", username)
+			c.Set(ldapAuthUserKey, username)
+			c.Next()
+			return
+		}
+
+		member, err := ldapAuthenticate(username, password, l)
+		if err != nil {
+			ldapErrorResponse(c, err)
+			c.Abort()
+			return
+		}
+		if !member {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if ttl > 0 {
+			ldapAuthCache.add(username, password, ttl)
+		}
+		l.Infof("%s authenticated", username)
+		c.Set(ldapAuthUserKey, username)
+		c.Next()
+	}
+}
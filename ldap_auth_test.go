@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestLDAPCredentialCache(t *testing.T) {
+	cache := newLDAPCredentialCache()
+	cache.add("alice", "pa55", time.Minute)
+	cache.add("bob", "expired", -time.Second)
+
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"alice", "pa55", true},
+		{"alice", "wrong", false},
+		{"alice\x00pa", "55", false},
+		{"bob", "expired", false},
+		{"carol", "pa55", false},
+	}
+	for _, test := range tests {
+		if got := cache.valid(test.username, test.password); got != test.want {
+			t.Errorf("valid(%q, %q) = %v, %v expected", test.username, test.password, got, test.want)
+		}
+	}
+
+	// the key is not the plain hash of the credentials and depends on the secret of the cache
+	plain := sha256.Sum256([]byte("alice\x00pa55"))
+	if _, ok := cache.entries[hex.EncodeToString(plain[:])]; ok {
+		t.Errorf("the key is the SHA-256 of the credentials")
+	}
+	if newLDAPCredentialCache().key("alice", "pa55") == cache.key("alice", "pa55") {
+		t.Errorf("two caches share the same key")
+	}
+}
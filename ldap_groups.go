@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- LDAP groups
+
+// ldapMatchingRuleInChain is the Active Directory rule to search the nested groups in one request
+const ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// ldapGroupsMaxDepth limits the recursive search of the nested groups
+const ldapGroupsMaxDepth = 10
+
+type ldapGroup struct {
+	DN     string `json:"dn"`
+	Name   string `json:"name"`
+	Direct bool   `json:"direct"`
+}
+
+type ldapGroupsResult struct {
+	Username string      `json:"username"`
+	DN       string      `json:"dn"`
+	Mode     string      `json:"mode"`
+	Count    int         `json:"count"`
+	Groups   []ldapGroup `json:"groups"`
+	Require  string      `json:"require,omitempty"`
+	Member   *bool       `json:"member,omitempty"`
+}
+
+func init() {
+	registerBatchJob("ldapgroups", "bind to LDAP_URL and list the groups of the user", `{"username": "user", "password": "secret", "require": "admins"}`, batchJobLDAPGroups)
+}
+
+// ldapUserEntry returns the entry of the bound user, read with its DN or searched with LDAP_USER_FILTER
+// when the user is bound with a UPN (user@domain) or DOMAIN\user
+func ldapUserEntry(conn *ldap.Conn, username string, bindDN string, l *logger) (*ldap.Entry, error) {
+	attributes := []string{"memberOf"}
+	if _, err := ldap.ParseDN(bindDN); err != nil || !strings.Contains(bindDN, "=") {
+		return ldapFindUser(conn, username, attributes, l)
+	}
+	request := ldap.NewSearchRequest(bindDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 10, false, "(objectClass=*)", attributes, nil)
+	sr, err := conn.Search(request)
+	if err != nil {
+		l.Errorf("Search user=%s", err.Error())
+		return nil, err
+	}
+	if len(sr.Entries) != 1 {
+		return nil, fmt.Errorf("user %s not found", bindDN)
+	}
+	return sr.Entries[0], nil
+}
+
+// ldapGroupName returns the value of the first RDN of the group (ex cn=admins,ou=groups -> admins)
+func ldapGroupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// ldapGroups returns the groups of the user (LDAP_GROUPS_MODE) :
+//   - memberof (default) : memberOf of the user, then memberOf of the groups for the nested groups
+//   - member : the groups of LDAP_GROUP_BASE with member/uniqueMember=<dn>, recursively
+//   - ad : one search with the Active Directory matching rule (member:1.2.840.113556.1.4.1941:=<dn>)
+func ldapGroups(conn *ldap.Conn, user *ldap.Entry, mode string, l *logger) ([]ldapGroup, error) {
+	groups := map[string]*ldapGroup{}
+	add := func(dn string, direct bool) bool {
+		key := strings.ToLower(dn)
+		if g, ok := groups[key]; ok {
+			g.Direct = g.Direct || direct
+			return false
+		}
+		groups[key] = &ldapGroup{DN: dn, Name: ldapGroupName(dn), Direct: direct}
+		return true
+	}
+	base := getenvs.GetEnvString("LDAP_GROUP_BASE", getenvs.GetEnvString("LDAP_SEARCH_BASE", os.Getenv("LDAP_BIND_DN")))
+	search := func(base string, scope int, filter string, attributes []string) ([]*ldap.Entry, error) {
+		l.Debugf("search groups base=%s filter=%s", base, filter)
+		sr, err := conn.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, 0, 10, false, filter, attributes, nil))
+		if err != nil {
+			l.Errorf("Search groups=%s", err.Error())
+			return nil, err
+		}
+		return sr.Entries, nil
+	}
+
+	switch mode {
+	case "memberof":
+		pending := user.GetAttributeValues("memberOf")
+		for _, dn := range pending {
+			add(dn, true)
+		}
+		for depth := 0; depth < ldapGroupsMaxDepth && len(pending) > 0; depth++ {
+			var next []string
+			for _, dn := range pending {
+				entries, err := search(dn, ldap.ScopeBaseObject, "(objectClass=*)", []string{"memberOf"})
+				if err != nil {
+					// the group may be outside of the rights of the user
+					continue
+				}
+				for _, e := range entries {
+					for _, parent := range e.GetAttributeValues("memberOf") {
+						if add(parent, false) {
+							next = append(next, parent)
+						}
+					}
+				}
+			}
+			pending = next
+		}
+	case "member":
+		pending := []string{user.DN}
+		for depth := 0; depth < ldapGroupsMaxDepth && len(pending) > 0; depth++ {
+			var next []string
+			for _, dn := range pending {
+				value := ldap.EscapeFilter(dn)
+				entries, err := search(base, ldap.ScopeWholeSubtree, "(|(member="+value+")(uniqueMember="+value+"))", []string{"dn"})
+				if err != nil {
+					return nil, err
+				}
+				for _, e := range entries {
+					if add(e.DN, depth == 0) {
+						next = append(next, e.DN)
+					}
+				}
+			}
+			pending = next
+		}
+	case "ad":
+		for _, dn := range user.GetAttributeValues("memberOf") {
+			add(dn, true)
+		}
+		entries, err := search(base, ldap.ScopeWholeSubtree, "(member:"+ldapMatchingRuleInChain+":="+ldap.EscapeFilter(user.DN)+")", []string{"dn"})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			add(e.DN, false)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown LDAP_GROUPS_MODE %s (memberof, member or ad)", errLDAPConfig, mode)
+	}
+
+	result := make([]ldapGroup, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, k int) bool { return strings.ToLower(result[i].DN) < strings.ToLower(result[k].DN) })
+	l.Infof("%d group(s) found for %s", len(result), user.DN)
+	return result, nil
+}
+
+// ldapIsMember checks the group by DN (the full DN, case insensitive), or by name when group is not a DN :
+// the name is the first RDN of any branch (admins matches cn=admins,ou=app1 and cn=admins,ou=app2), it is
+// refused when several groups of the user have this name, use the DN to check a group of one branch
+func ldapIsMember(groups []ldapGroup, group string) bool {
+	if !strings.Contains(group, "=") {
+		found := 0
+		for _, g := range groups {
+			if strings.EqualFold(g.Name, group) {
+				found++
+			}
+		}
+		return found == 1
+	}
+	required, err := ldap.ParseDN(group)
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if dn, err := ldap.ParseDN(g.DN); err == nil && dn.EqualFold(required) {
+			return true
+		}
+	}
+	return false
+}
+
+// ldapUserGroups binds with the user and returns its groups, with the membership of require
+func ldapUserGroups(username string, password string, require string, l *logger) (*ldapGroupsResult, error) {
+	conn, bindDN, err := ldapBindConn(username, password, l)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	user, err := ldapUserEntry(conn, username, bindDN, l)
+	if err != nil {
+		return nil, err
+	}
+	mode := strings.ToLower(getenvs.GetEnvString("LDAP_GROUPS_MODE", "memberof"))
+	groups, err := ldapGroups(conn, user, mode, l)
+	if err != nil {
+		return nil, err
+	}
+	result := &ldapGroupsResult{Username: username, DN: user.DN, Mode: mode, Count: len(groups), Groups: groups}
+	if len(require) > 0 {
+		member := ldapIsMember(groups, require)
+		result.Require = require
+		result.Member = &member
+		if !member {
+			l.Warnf("%s is not a member of %s", username, require)
+		}
+	}
+	return result, nil
+}
+
+// ---- swagger Informations
+// @Tags         Endpoints
+// @router /v1/ldap/groups [get]
+// @summary Bind to the LDAP and list the groups (direct and nested) of the user
+// @security BasicAuth
+// @produce application/json
+// @param require query string false "Group (DN or name) required, 403 if the user is not a member"
+// @success 200 {object} ldapGroupsResult
+// @failure 401 string Unauthorized
+// @failure 403 {object} ldapGroupsResult
+// @failure 500 string Internal Server Error
+func ldapGroupsHandler(c *gin.Context) {
+	username, password, ok := c.Request.BasicAuth()
+	if !ok {
+		ldapUnauthorized(c)
+		return
+	}
+	result, err := ldapUserGroups(username, password, c.Query("require"), requestLogger(c, "LDAP"))
+	if err != nil {
+		ldapErrorResponse(c, err)
+		return
+	}
+	if result.Member != nil && !*result.Member {
+		c.JSON(http.StatusForbidden, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// function for Job
+func batchJobLDAPGroups(argValues string) (interface{}, error) {
+	var data struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Require  string `json:"require"`
+	}
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Username) == 0 {
+		return nil, fmt.Errorf("%w: username is required", errBatchArgument)
+	}
+	result, err := ldapUserGroups(data.Username, data.Password, data.Require, newLogger("BATCH/LDAP"))
+	if err != nil {
+		return nil, err
+	}
+	if result.Member != nil && !*result.Member {
+		return result, fmt.Errorf("%s is not a member of %s", data.Username, data.Require)
+	}
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestLDAPIsMember(t *testing.T) {
+	groups := []ldapGroup{
+		{DN: "cn=admins,ou=groups,dc=example,dc=org", Name: "admins"},
+		{DN: "CN=Dev Team,OU=Groups,DC=example,DC=org", Name: "Dev Team"},
+	}
+	tests := []struct {
+		group string
+		want  bool
+	}{
+		{"cn=admins,ou=groups,dc=example,dc=org", true},
+		{"CN=Admins, OU=groups, DC=Example, DC=org", true},
+		{"cn=dev team,ou=groups,dc=example,dc=org", true},
+		{"admins", true},
+		{"ADMINS", true},
+		{"dev team", true},
+		// same name in another branch
+		{"cn=admins,ou=other,dc=example,dc=org", false},
+		{"cn=admins", false},
+		{"cn=admins,ou=groups,dc=example", false},
+		{"ou=groups,dc=example,dc=org", false},
+		{"users", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := ldapIsMember(groups, test.group); got != test.want {
+			t.Errorf("ldapIsMember(%q) = %v, %v expected", test.group, got, test.want)
+		}
+	}
+
+	// the name of two groups of the user is ambiguous, the DN is accepted
+	groups = append(groups, ldapGroup{DN: "cn=admins,ou=app2,dc=example,dc=org", Name: "admins"})
+	if ldapIsMember(groups, "admins") {
+		t.Errorf("ldapIsMember(admins) accepted with two groups named admins")
+	}
+	if !ldapIsMember(groups, "cn=admins,ou=app2,dc=example,dc=org") {
+		t.Errorf("ldapIsMember refused the DN of a group of the user")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- LDAP servers and pool of the service account
+
+// ldapNext is the first server of the next connection with the round-robin strategy
+var ldapNext uint32
+
+// ldapPool keeps the connections bound with the service account (search mode)
+var ldapPool = &ldapConnPool{}
+
+type ldapConnPool struct {
+	mu      sync.Mutex
+	idle    []*ldap.Conn
+	created int
+	reused  int
+}
+
+type ldapPoolStats struct {
+	Size    int `json:"size"`
+	Idle    int `json:"idle"`
+	Created int `json:"created"`
+	Reused  int `json:"reused"`
+}
+
+type ldapServerHealth struct {
+	URL         string   `json:"url"`
+	Reachable   bool     `json:"reachable"`
+	ConnectTime string   `json:"connect_time,omitempty"`
+	BindTime    string   `json:"bind_time,omitempty"`
+	TLS         *tlsInfo `json:"tls,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type ldapHealthResult struct {
+	Strategy string             `json:"strategy"`
+	Servers  []ldapServerHealth `json:"servers"`
+	Pool     ldapPoolStats      `json:"pool"`
+}
+
+func init() {
+	registerBatchJob("ldaphealth", "connect to each server of LDAP_URL and report the bind latency", `{}`, batchJobLDAPHealth)
+}
+
+// ldapURLs returns the servers of LDAP_URL (comma or space separated)
+func ldapURLs() []string {
+	return strings.FieldsFunc(os.Getenv("LDAP_URL"), func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// ldapStrategy returns LDAP_URL_STRATEGY : failover (default, in the order of LDAP_URL) or round-robin
+func ldapStrategy() string {
+	return strings.ToLower(getenvs.GetEnvString("LDAP_URL_STRATEGY", "failover"))
+}
+
+// ldapConnect connects to the first reachable server of LDAP_URL, it returns the URL of the server
+func ldapConnect(l *logger) (*ldap.Conn, string, error) {
+	urls := ldapURLs()
+	if len(urls) == 0 {
+		l.Errorf("LDAP_URL is not set")
+		return nil, "", fmt.Errorf("%w: LDAP_URL is not set", errLDAPConfig)
+	}
+	start := 0
+	if ldapStrategy() == "round-robin" {
+		start = int(atomic.AddUint32(&ldapNext, 1)-1) % len(urls)
+	}
+	var err error
+	for i := range urls {
+		ldapURL := urls[(start+i)%len(urls)]
+		var conn *ldap.Conn
+		conn, err = ldapDial(ldapURL, l)
+		if err == nil {
+			return conn, ldapURL, nil
+		}
+		if i < len(urls)-1 {
+			l.Warnf("%s is not reachable, next server", ldapURL)
+		}
+	}
+	return nil, "", err
+}
+
+// ldapServiceBind binds with the service account (LDAP_SERVICE_DN, LDAP_SERVICE_PASSWORD)
+func ldapServiceBind(conn *ldap.Conn, l *logger) error {
+	serviceDN := os.Getenv("LDAP_SERVICE_DN")
+	l.Debugf("LDAP_SERVICE_DN=%s", serviceDN)
+	if err := conn.Bind(serviceDN, os.Getenv("LDAP_SERVICE_PASSWORD")); err != nil {
+		l.Errorf("Bind service account=%s", err.Error())
+		return fmt.Errorf("%w: service account : %s", errLDAPConfig, err.Error())
+	}
+	return nil
+}
+
+// get returns an idle connection of the service account, or a new one
+func (p *ldapConnPool) get(l *logger) (*ldap.Conn, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !conn.IsClosing() {
+			p.reused++
+			p.mu.Unlock()
+			return conn, nil
+		}
+	}
+	p.mu.Unlock()
+
+	conn, _, err := ldapConnect(l)
+	if err != nil {
+		return nil, err
+	}
+	if err := ldapServiceBind(conn, l); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.mu.Lock()
+	p.created++
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// put gives back the connection, it is closed after a network error or when LDAP_POOL_SIZE idle connections are kept
+func (p *ldapConnPool) put(conn *ldap.Conn, err error) {
+	size, _ := strconv.Atoi(getenvs.GetEnvString("LDAP_POOL_SIZE", "4"))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || conn.IsClosing() || len(p.idle) >= size {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, conn)
+}
+
+func (p *ldapConnPool) stats() ldapPoolStats {
+	size, _ := strconv.Atoi(getenvs.GetEnvString("LDAP_POOL_SIZE", "4"))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ldapPoolStats{Size: size, Idle: len(p.idle), Created: p.created, Reused: p.reused}
+}
+
+// ldapWithServiceAccount runs f with a connection of the pool, f is run again with a new connection
+// when an idle connection was closed by the server
+func ldapWithServiceAccount(l *logger, f func(conn *ldap.Conn) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *ldap.Conn
+		conn, err = ldapPool.get(l)
+		if err != nil {
+			return err
+		}
+		err = f(conn)
+		ldapPool.put(conn, err)
+		if !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			return err
+		}
+	}
+	return err
+}
+
+// ldapHealth connects to each server, binds with the service account (when LDAP_SERVICE_DN is set)
+// and measures the latency
+func ldapHealth(l *logger) *ldapHealthResult {
+	result := &ldapHealthResult{Strategy: ldapStrategy(), Servers: []ldapServerHealth{}}
+	for _, ldapURL := range ldapURLs() {
+		server := ldapServerHealth{URL: ldapURL}
+		start := time.Now()
+		conn, err := ldapDial(ldapURL, l)
+		if err != nil {
+			server.Error = err.Error()
+			result.Servers = append(result.Servers, server)
+			continue
+		}
+		server.ConnectTime = time.Since(start).String()
+		server.TLS = ldapTLSReport(conn)
+		server.Reachable = true
+		if len(os.Getenv("LDAP_SERVICE_DN")) > 0 {
+			start = time.Now()
+			if err := ldapServiceBind(conn, l); err != nil {
+				server.Reachable = false
+				server.Error = err.Error()
+			} else {
+				server.BindTime = time.Since(start).String()
+			}
+		}
+		conn.Close()
+		l.Infof("%s reachable=%t connect=%s bind=%s", ldapURL, server.Reachable, server.ConnectTime, server.BindTime)
+		result.Servers = append(result.Servers, server)
+	}
+	result.Pool = ldapPool.stats()
+	return result
+}
+
+// ---- swagger Informations
+// @Tags         Endpoints
+// @router /v1/ldap/health [get]
+// @summary Connect to each server of LDAP_URL and report the connect and bind latency
+// @produce application/json
+// @success 200 {object} ldapHealthResult
+// @failure 503 {object} ldapHealthResult
+func ldapHealthHandler(c *gin.Context) {
+	result := ldapHealth(requestLogger(c, "LDAP"))
+	for _, server := range result.Servers {
+		if server.Reachable {
+			c.JSON(http.StatusOK, result)
+			return
+		}
+	}
+	c.JSON(http.StatusServiceUnavailable, result)
+}
+
+// function for Job
+func batchJobLDAPHealth(argValues string) (interface{}, error) {
+	result := ldapHealth(newLogger("BATCH/LDAP"))
+	var down []string
+	for _, server := range result.Servers {
+		if !server.Reachable {
+			down = append(down, server.URL)
+		}
+	}
+	if len(result.Servers) == 0 {
+		return result, fmt.Errorf("%w: LDAP_URL is not set", errBatchArgument)
+	}
+	if len(down) > 0 {
+		return result, fmt.Errorf("not reachable : %s", strings.Join(down, ", "))
+	}
+	return result, nil
+}
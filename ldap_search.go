@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- LDAP search
+
+var errLDAPSearchArgument = errors.New("invalid LDAP search")
+
+// ldapSearchOptions are the parameters of a search
+type ldapSearchOptions struct {
+	Base       string   `json:"base"`
+	Filter     string   `json:"filter"`
+	Scope      string   `json:"scope"` // base, one or sub
+	Attributes []string `json:"attributes"`
+	SizeLimit  int      `json:"size_limit"`
+}
+
+type ldapSearchEntry struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+type ldapSearchResult struct {
+	Base      string            `json:"base"`
+	Filter    string            `json:"filter"`
+	Scope     string            `json:"scope"`
+	Count     int               `json:"count"`
+	Truncated bool              `json:"truncated"`
+	Entries   []ldapSearchEntry `json:"entries"`
+}
+
+var ldapScopes = map[string]int{
+	"base": ldap.ScopeBaseObject,
+	"one":  ldap.ScopeSingleLevel,
+	"sub":  ldap.ScopeWholeSubtree,
+}
+
+func init() {
+	registerBatchJob("ldapsearch", "bind to LDAP_URL and run a search", `{"username": "user", "password": "secret", "filter": "(uid=user)", "attributes": ["cn", "memberOf"]}`, batchJobLDAPSearch)
+}
+
+// validate applies the default values (LDAP_SEARCH_BASE, LDAP_SEARCH_FILTER) and the limit LDAP_SEARCH_MAX_SIZE
+func (o *ldapSearchOptions) validate() error {
+	maxSize, _ := strconv.Atoi(getenvs.GetEnvString("LDAP_SEARCH_MAX_SIZE", "1000"))
+	if len(o.Base) == 0 {
+		o.Base = getenvs.GetEnvString("LDAP_SEARCH_BASE", os.Getenv("LDAP_BIND_DN"))
+	}
+	if len(o.Filter) == 0 {
+		o.Filter = getenvs.GetEnvString("LDAP_SEARCH_FILTER", "(objectClass=*)")
+	}
+	if len(o.Scope) == 0 {
+		o.Scope = "sub"
+	}
+	o.Scope = strings.ToLower(o.Scope)
+	if o.SizeLimit == 0 {
+		o.SizeLimit = 100
+	}
+	if _, ok := ldapScopes[o.Scope]; !ok {
+		return fmt.Errorf("%w: scope must be base, one or sub", errLDAPSearchArgument)
+	}
+	if o.SizeLimit < 0 || o.SizeLimit > maxSize {
+		return fmt.Errorf("%w: size_limit must be between 1 and %d", errLDAPSearchArgument, maxSize)
+	}
+	if _, err := ldap.CompileFilter(o.Filter); err != nil {
+		return fmt.Errorf("%w: filter %s : %s", errLDAPSearchArgument, o.Filter, err.Error())
+	}
+	return nil
+}
+
+// ldapSearch runs the search on a bound connection
+func ldapSearch(conn *ldap.Conn, opts ldapSearchOptions, l *logger) (*ldapSearchResult, error) {
+	timeout, _ := strconv.Atoi(getenvs.GetEnvString("LDAP_SEARCH_TIMEOUT", "10"))
+	l.Infof("search base=%s filter=%s scope=%s attributes=%s size_limit=%d", opts.Base, opts.Filter, opts.Scope, strings.Join(opts.Attributes, ","), opts.SizeLimit)
+	request := ldap.NewSearchRequest(opts.Base, ldapScopes[opts.Scope], ldap.NeverDerefAliases,
+		opts.SizeLimit, timeout, false, opts.Filter, opts.Attributes, nil)
+
+	result := &ldapSearchResult{Base: opts.Base, Filter: opts.Filter, Scope: opts.Scope, Entries: []ldapSearchEntry{}}
+	sr, err := conn.Search(request)
+	if err != nil {
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || sr == nil {
+			l.Errorf("Search=%s", err.Error())
+			return nil, err
+		}
+		result.Truncated = true
+	}
+	for _, entry := range sr.Entries {
+		result.Entries = append(result.Entries, newLDAPSearchEntry(entry))
+	}
+	result.Count = len(result.Entries)
+	l.Infof("%d entries found", result.Count)
+	return result, nil
+}
+
+// newLDAPSearchEntry converts an entry, the binary values (objectGUID ...) are encoded in base64
+// and the passwords are masked
+func newLDAPSearchEntry(entry *ldap.Entry) ldapSearchEntry {
+	e := ldapSearchEntry{DN: entry.DN, Attributes: map[string][]string{}}
+	for _, attribute := range entry.Attributes {
+		name := strings.ToLower(attribute.Name)
+		sensitive := strings.Contains(name, "password") || strings.Contains(name, "pwd")
+		values := make([]string, 0, len(attribute.ByteValues))
+		for _, raw := range attribute.ByteValues {
+			switch {
+			case sensitive:
+				values = append(values, maskSecret(string(raw)))
+			case utf8.Valid(raw):
+				values = append(values, string(raw))
+			default:
+				values = append(values, "base64:"+base64.StdEncoding.EncodeToString(raw))
+			}
+		}
+		e.Attributes[attribute.Name] = values
+	}
+	return e
+}
+
+// ---- swagger Informations
+// @Tags         Endpoints
+// @router /v1/ldap/search [get]
+// @summary Bind to the LDAP and run a search
+// @security BasicAuth
+// @produce application/json
+// @param base query string false "Base DN (LDAP_SEARCH_BASE or LDAP_BIND_DN by default)"
+// @param filter query string false "Filter (default (objectClass=*))"
+// @param scope query string false "base, one or sub (default)"
+// @param attributes query string false "Attributes, comma separated (all by default)"
+// @param size_limit query int false "Maximum number of entries (default 100, max LDAP_SEARCH_MAX_SIZE)"
+// @success 200 {object} ldapSearchResult
+// @failure 400 string Bad request
+// @failure 401 string Unauthorized
+// @failure 404 string Not Found
+// @failure 500 string Internal Server Error
+func ldapSearchHandler(c *gin.Context) {
+	username, password, ok := c.Request.BasicAuth()
+	if !ok {
+		ldapUnauthorized(c)
+		return
+	}
+	opts := ldapSearchOptions{Base: c.Query("base"), Filter: c.Query("filter"), Scope: c.Query("scope")}
+	if attributes := c.Query("attributes"); len(attributes) > 0 {
+		for _, a := range strings.Split(attributes, ",") {
+			if a = strings.TrimSpace(a); len(a) > 0 {
+				opts.Attributes = append(opts.Attributes, a)
+			}
+		}
+	}
+	opts.SizeLimit, _ = strconv.Atoi(c.Query("size_limit"))
+	if err := opts.validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	l := requestLogger(c, "LDAP")
+	conn, _, err := ldapBindConn(username, password, l)
+	if err != nil {
+		ldapErrorResponse(c, err)
+		return
+	}
+	defer conn.Close()
+
+	result, err := ldapSearch(conn, opts, l)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// function for Job
+func batchJobLDAPSearch(argValues string) (interface{}, error) {
+	var data struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		ldapSearchOptions
+	}
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Username) == 0 {
+		return nil, fmt.Errorf("%w: username is required", errBatchArgument)
+	}
+	if err := data.ldapSearchOptions.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", errBatchArgument, err.Error())
+	}
+	l := newLogger("BATCH/LDAP")
+	conn, _, err := ldapBindConn(data.Username, data.Password, l)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ldapSearch(conn, data.ldapSearchOptions, l)
+}
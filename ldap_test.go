@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestLDAPEscapeDN(t *testing.T) {
+	tests := map[string]string{
+		"alice":          "alice",
+		"doe, john":      `doe\, john`,
+		"a+b":            `a\+b`,
+		`quote"d`:        `quote\"d`,
+		"<admin>;x":      `\<admin\>\;x`,
+		"cn=admin":       `cn\=admin`,
+		`back\slash`:     `back\\slash`,
+		"#hash":          `\#hash`,
+		"not#first":      "not#first",
+		" spaces ":       `\ spaces\ `,
+		"inner space":    "inner space",
+		"admin,ou=other": `admin\,ou\=other`,
+	}
+	for value, want := range tests {
+		got := ldapEscapeDN(value)
+		if got != want {
+			t.Errorf("ldapEscapeDN(%q) = %q, %q expected", value, got, want)
+			continue
+		}
+		// the escaped value is one attribute value of the DN
+		dn, err := ldap.ParseDN("cn=" + got + ",dc=example,dc=org")
+		if err != nil || len(dn.RDNs) != 3 || dn.RDNs[0].Attributes[0].Value != value {
+			t.Errorf("ParseDN(cn=%s) = %v, %v", got, dn, err)
+		}
+	}
+}
+
+func TestLDAPTemplateDN(t *testing.T) {
+	tests := []struct {
+		template string
+		username string
+		want     string
+	}{
+		{"uid={username},ou=people,dc=example,dc=org", "alice", "uid=alice,ou=people,dc=example,dc=org"},
+		{"uid={username},ou=people,dc=example,dc=org", "x,ou=admins", `uid=x\,ou\=admins,ou=people,dc=example,dc=org`},
+		{"{username}@example.org", "alice", "alice@example.org"},
+		{`EXAMPLE\{username}`, "alice", `EXAMPLE\alice`},
+	}
+	for _, test := range tests {
+		if got := ldapTemplateDN(test.template, test.username); got != test.want {
+			t.Errorf("ldapTemplateDN(%q, %q) = %q, %q expected", test.template, test.username, got, test.want)
+		}
+	}
+}
+
+func TestLDAPUserFilter(t *testing.T) {
+	t.Setenv("LDAP_USER_FILTER", "(&(objectClass=person)(uid={username}))")
+	tests := map[string]string{
+		"alice":         "(&(objectClass=person)(uid=alice))",
+		"*":             `(&(objectClass=person)(uid=\2a))`,
+		"a)(uid=*":      `(&(objectClass=person)(uid=a\29\28uid=\2a))`,
+		`x\y`:           `(&(objectClass=person)(uid=x\5cy))`,
+		"nul\x00":       `(&(objectClass=person)(uid=nul\00))`,
+		"admin)(|(a=b)": `(&(objectClass=person)(uid=admin\29\28|\28a=b\29))`,
+	}
+	for username, want := range tests {
+		got := ldapUserFilter(username)
+		if got != want {
+			t.Errorf("ldapUserFilter(%q) = %q, %q expected", username, got, want)
+		}
+		if _, err := ldap.CompileFilter(got); err != nil {
+			t.Errorf("CompileFilter(%q) = %v", got, err)
+		}
+	}
+}
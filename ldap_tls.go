@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- LDAP TLS
+
+// ldapTLSConfig contains the TLS parameters (LDAP_TLS_* variables)
+type ldapTLSConfig struct {
+	CA         string // PEM bundle of CA certificates (system CAs by default)
+	Cert       string // client certificate (mTLS)
+	Key        string // client key (mTLS)
+	ServerName string // name in the server certificate (host of LDAP_URL by default)
+	Verify     bool   // verify the certificate of the server (true by default)
+	StartTLS   bool   // StartTLS on the ldap:// URLs
+}
+
+func ldapTLSConfigFromEnv() ldapTLSConfig {
+	verify, _ := getenvs.GetEnvBool("LDAP_TLS_VERIFY", true)
+	startTLS, _ := getenvs.GetEnvBool("LDAP_STARTTLS", false)
+	return ldapTLSConfig{
+		CA:         os.Getenv("LDAP_TLS_CA"),
+		Cert:       os.Getenv("LDAP_TLS_CERT"),
+		Key:        os.Getenv("LDAP_TLS_KEY"),
+		ServerName: os.Getenv("LDAP_TLS_SERVER_NAME"),
+		Verify:     verify,
+		StartTLS:   startTLS,
+	}
+}
+
+// tlsConfig returns the crypto/tls configuration for the host of the LDAP URL
+func (t ldapTLSConfig) tlsConfig(host string) (*tls.Config, error) {
+	if (len(t.Cert) > 0) != (len(t.Key) > 0) {
+		return nil, errors.New("LDAP_TLS_CERT and LDAP_TLS_KEY must be set together")
+	}
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: !t.Verify}
+	if len(t.ServerName) > 0 {
+		config.ServerName = t.ServerName
+	}
+	if len(t.CA) > 0 {
+		pool, err := loadCertPool(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(t.Cert) > 0 {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ldapDial connects to the LDAP URL, with TLS for ldaps:// and with StartTLS for ldap:// when LDAP_STARTTLS is true
+func ldapDial(ldapURL string, l *logger) (*ldap.Conn, error) {
+	l.Debugf("LDAP_URL=%s", ldapURL)
+	u, err := url.Parse(ldapURL)
+	if err != nil {
+		l.Errorf("URL=%s", err.Error())
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	host := u.Hostname()
+	cfg := ldapTLSConfigFromEnv()
+	config, err := cfg.tlsConfig(host)
+	if err != nil {
+		l.Errorf("TLS=%s", err.Error())
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	if !cfg.Verify {
+		l.Warnf("the certificate of the LDAP server is not verified (LDAP_TLS_VERIFY=false)")
+	}
+
+	timeout, err := time.ParseDuration(getenvs.GetEnvString("LDAP_TIMEOUT", "5s"))
+	if err != nil {
+		timeout = 5 * time.Second
+	}
+	conn, err := ldap.DialURL(ldapURL, ldap.DialWithTLSConfig(config), ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		l.Errorf("Dial=%s", err.Error())
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if cfg.StartTLS && strings.ToLower(u.Scheme) == "ldap" {
+		l.Debugf("StartTLS")
+		if err := conn.StartTLS(config); err != nil {
+			l.Errorf("StartTLS=%s", err.Error())
+			conn.Close()
+			return nil, err
+		}
+	}
+	if state, ok := conn.TLSConnectionState(); ok {
+		l.Debugf("TLS=%s %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	return conn, nil
+}
+
+// ldapTLSReport returns the TLS report of the connection (nil without TLS)
+func ldapTLSReport(conn *ldap.Conn) *tlsInfo {
+	state, ok := conn.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return newTLSInfo(state)
+}
+
+// ---- swagger Informations
+// @Tags         Endpoints
+// @router /v1/ldap/tls [get]
+// @summary Connect to the LDAP (TLS or StartTLS) and report the TLS version, the cipher and the certificates of the server
+// @produce application/json
+// @success 200 {object} tlsInfo
+// @failure 502 {object} tlsInfo
+func ldapTLSHandler(c *gin.Context) {
+	conn, ldapURL, err := ldapConnect(requestLogger(c, "LDAP"))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, &tlsInfo{Error: err.Error()})
+		return
+	}
+	defer conn.Close()
+	host := ldapURL
+	if u, err := url.Parse(ldapURL); err == nil {
+		host = u.Hostname()
+	}
+	report := ldapTLSReport(conn)
+	if report == nil {
+		report = &tlsInfo{ServerName: host, Error: "disabled (use ldaps:// or LDAP_STARTTLS=true)"}
+	}
+	c.JSON(http.StatusOK, report)
+}
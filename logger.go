@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --------------------------- Logs
+
+const requestIDHeader = "X-Request-ID"
+
+// logFormat is text (default) or json (--log-format)
+var logFormat string
+
+// logLevelName is the level at startup (--log-level)
+var logLevelName string
+
+// logLevel is the minimum level of the logs, it can be changed at runtime (/v1/admin/loglevel)
+var logLevel = new(slog.LevelVar)
+
+var errLogLevel = errors.New("unknown log level (debug, info, warn or error)")
+
+// logger writes the logs of a component (LDAP, ECHO ...), with the request id in server mode
+type logger struct {
+	s *slog.Logger
+}
+
+// initLogger installs the handler of --log-format for the logs of macgover, log and gin
+func initLogger() error {
+	level, err := parseLogLevel(logLevelName)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	var handler slog.Handler
+	out := redactWriter{os.Stderr}
+	switch strings.ToLower(logFormat) {
+	case "text", "":
+		handler = &textLogHandler{mu: &sync.Mutex{}, out: out, level: logLevel}
+	case "json":
+		handler = slog.NewJSONHandler(out, &slog.HandlerOptions{Level: logLevel})
+	default:
+		return fmt.Errorf("unknown log format %s (text or json)", logFormat)
+	}
+	// log.Printf of the dependencies are written with the same handler
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+	return nil
+}
+
+// parseLogLevel converts debug, info, warn (warning) or error
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("%w: %s", errLogLevel, name)
+}
+
+func logLevelString(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+func newLogger(component string) *logger {
+	return &logger{s: slog.Default().With("component", component)}
+}
+
+// requestLogger returns the logger of the component with the request id of the request
+func requestLogger(c *gin.Context, component string) *logger {
+	return &logger{s: slog.Default().With("component", component, "request_id", c.GetString("request_id"))}
+}
+
+// With returns a logger with more attributes
+func (l *logger) With(args ...interface{}) *logger {
+	return &logger{s: l.s.With(args...)}
+}
+
+func (l *logger) Debugf(format string, args ...interface{}) {
+	if l.s.Enabled(context.Background(), slog.LevelDebug) {
+		l.s.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.s.Info(fmt.Sprintf(format, args...))
+}
+
+func (l *logger) Warnf(format string, args ...interface{}) {
+	l.s.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.s.Error(fmt.Sprintf(format, args...))
+}
+
+// newRequestID returns a random id of 16 bytes (hex)
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestLogMiddleware replaces the logger of gin: it takes the X-Request-ID (or generates one),
+// returns it in the response and logs the request with its status and latency
+func requestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := c.GetHeader(requestIDHeader)
+		if len(requestID) == 0 || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		c.Set("request_id", requestID)
+		c.Header(requestIDHeader, requestID)
+
+		c.Next()
+
+		path := c.Request.URL.Path
+		if len(c.Request.URL.RawQuery) > 0 {
+			path += "?" + redactQuery(c.Request.URL.Query()).Encode()
+		}
+		l := requestLogger(c, "HTTP").With(
+			"method", c.Request.Method,
+			"path", path,
+			"status", c.Writer.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"client_ip", c.ClientIP(),
+			"size", c.Writer.Size(),
+		)
+		msg := fmt.Sprintf("%s %s %d", c.Request.Method, path, c.Writer.Status())
+		switch {
+		case len(c.Errors) > 0:
+			l.Errorf("%s %s", msg, c.Errors.String())
+		case c.Writer.Status() >= http.StatusInternalServerError:
+			l.Errorf("%s", msg)
+		case c.Writer.Status() >= http.StatusBadRequest:
+			l.Warnf("%s", msg)
+		default:
+			l.Infof("%s", msg)
+		}
+	}
+}
+
+// ---- swagger Informations
+// @Tags         Admin
+// @router /v1/admin/loglevel [get]
+// @summary Display the level of the logs
+// @security BearerAuth
+// @produce application/json
+// @success 200 string OK
+// @failure 401 string Unauthorized
+// @failure 403 string Forbidden
+func logLevelHandler(c *gin.Context) {
+	if !adminAuthorized(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"level": logLevelString(logLevel.Level())})
+}
+
+// ---- swagger Informations
+// @Tags         Admin
+// @router /v1/admin/loglevel [put]
+// @summary Change the level of the logs without restarting
+// @security BearerAuth
+// @param level query string true "debug, info, warn or error"
+// @produce application/json
+// @success 200 string OK
+// @failure 400 string Bad request
+// @failure 401 string Unauthorized
+// @failure 403 string Forbidden
+func updateLogLevelHandler(c *gin.Context) {
+	if !adminAuthorized(c) {
+		return
+	}
+	name := c.Query("level")
+	if len(name) == 0 {
+		var data struct {
+			Level string `json:"level"`
+		}
+		if err := c.ShouldBindJSON(&data); err == nil {
+			name = data.Level
+		}
+	}
+	if len(name) == 0 {
+		c.String(http.StatusBadRequest, "level is required (debug, info, warn or error)")
+		return
+	}
+	level, err := parseLogLevel(name)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	requestLogger(c, "ADMIN").Warnf("log level changed from %s to %s", logLevelString(previous), logLevelString(level))
+	c.JSON(http.StatusOK, gin.H{"level": logLevelString(level), "previous": logLevelString(previous)})
+}
+
+// adminAuthorized checks the bearer token of the admin endpoints (MACGOVER_ADMIN_TOKEN),
+// the endpoints are closed when the variable is not set
+func adminAuthorized(c *gin.Context) bool {
+	token := os.Getenv("MACGOVER_ADMIN_TOKEN")
+	if len(token) == 0 {
+		requestLogger(c, "ADMIN").Warnf("%s refused, MACGOVER_ADMIN_TOKEN is not set", c.Request.URL.Path)
+		c.String(http.StatusForbidden, "admin token not configured")
+		return false
+	}
+	given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="Macgover"`)
+		c.String(http.StatusUnauthorized, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// textLogHandler writes the logs like "2006/01/02 15:04:05 [COMPONENT] LEVEL : message key=value"
+type textLogHandler struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	level slog.Leveler
+	attrs []slog.Attr
+}
+
+func (h *textLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textLogHandler) Handle(_ context.Context, r slog.Record) error {
+	component := ""
+	var extras []string
+	add := func(a slog.Attr) bool {
+		if a.Key == "component" {
+			component = a.Value.String()
+			return true
+		}
+		if value := a.Value.String(); len(value) > 0 {
+			extras = append(extras, a.Key+"="+value)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+
+	var b strings.Builder
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	if len(component) > 0 {
+		b.WriteString("[" + component + "] ")
+	}
+	b.WriteString(r.Level.String() + " : " + strings.TrimRight(r.Message, "\n"))
+	if len(extras) > 0 {
+		b.WriteString(" (" + strings.Join(extras, " ") + ")")
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, b.String())
+	return err
+}
+
+func (h *textLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &textLogHandler{mu: h.mu, out: h.out, level: h.level, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *textLogHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
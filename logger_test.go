@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuthorized(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"not configured", "", "", http.StatusForbidden},
+		{"not configured with a header", "", "Bearer ", http.StatusForbidden},
+		{"missing header", "adm1n", "", http.StatusUnauthorized},
+		{"wrong token", "adm1n", "Bearer wrong", http.StatusUnauthorized},
+		{"valid token", "adm1n", "Bearer adm1n", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MACGOVER_ADMIN_TOKEN", test.token)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/v1/admin/loglevel", nil)
+			if len(test.header) > 0 {
+				c.Request.Header.Set("Authorization", test.header)
+			}
+			logLevelHandler(c)
+			if w.Code != test.want {
+				t.Fatalf("status %d, %d expected", w.Code, test.want)
+			}
+		})
+	}
+}
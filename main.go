@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"html/template"
 	"io/fs"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -57,6 +56,14 @@ func init() {
 	flag.StringVar(&mode, "mode", getenvs.GetEnvString("MACGOVER_MODE", "server"), "give me a mode to start")
 	flag.StringVar(&job, "job", getenvs.GetEnvString("MACGOVER_JOB", "metrics"), "give me a job name")
 	flag.StringVar(&argument, "argument", getenvs.GetEnvString("MACGOVER_ARGUMENT", "{}"), "give me a argument")
+	reveal, _ := getenvs.GetEnvBool("MACGOVER_REVEAL_SECRETS", false)
+	flag.BoolVar(&revealSecrets, "reveal-secrets", reveal, "display the passwords, tokens ... in the logs (debug only)")
+	flag.StringVar(&logLevelName, "log-level", getenvs.GetEnvString("MACGOVER_LOG_LEVEL", "info"), "minimum level of the logs (debug, info, warn or error)")
+	flag.StringVar(&logFormat, "log-format", getenvs.GetEnvString("MACGOVER_LOG_FORMAT", "text"), "format of the logs (text or json)")
+
+	registerBatchJob("metrics", "post a metric on the pushgateway (PUSHMETRICS_URL)", `{"job": "macgover_batch_job", "label": "macgover_batch_label", "value": 1}`, batchJobMetrics)
+	registerBatchJob("url", "check the connection with a website", `{"url": "https://www.ecosia.org/", "expected_status": 200}`, batchJobURL)
+	registerBatchJob("network", "check the connection on @ip port", `{"host": "localhost", "port": "3000", "protocol": "tcp"}`, batchJobNetwork)
 }
 
 func updateTitleSwagger(c *ginSwagger.Config) {
@@ -66,22 +73,45 @@ func updateTitleSwagger(c *ginSwagger.Config) {
 
 
 func main() {
-	log.Println("------------------------ Start MACGOVER ------------------------")
 	flag.Parse()
+	if err := initLogger(); err != nil {
+		log.Printf("ERROR : %s", err.Error())
+		os.Exit(batchExitInvalid)
+	}
+	l := newLogger("MAIN")
+	l.Infof("------------------------ Start MACGOVER ------------------------")
 
 	mode = strings.ToLower(mode)
-	log.Printf("Mode=%s", mode)
+	l.Infof("Mode=%s", mode)
+	if revealSecrets {
+		l.Warnf("the secrets are displayed in the logs (--reveal-secrets)")
+	}
 
 	switch strings.ToLower(mode) {
 	case "server":
+		initDBTargets()
+		initDBQueries()
+		initJWTKeys()
+		if err := validateAuthRoutes(); err != nil {
+			l.Errorf("%s", err.Error())
+			os.Exit(batchExitInvalid)
+		}
+		if _, err := oidcIssuer(); oidcEnabled() && err != nil {
+			l.Errorf("OIDC provider : %s", err.Error())
+			os.Exit(batchExitInvalid)
+		}
 
-		router := gin.Default()
+		// the requests are logged by requestLogMiddleware (X-Request-ID, status, latency)
+		router := gin.New()
+		router.Use(requestLogMiddleware(), gin.Recovery())
 
 		tmpl := template.Must(template.New("").ParseFS(embeddedFS, "templates/*.tmpl"))
 		router.SetHTMLTemplate(tmpl)
 
 		router.GET("/", redirectIndex)
 		router.GET("/macgover", macgoverHandler)
+		router.GET("/.well-known/jwks.json", jwksHandler)
+		router.GET("/.well-known/openid-configuration", oidcDiscoveryHandler)
 
 
 		//swaggerHandler := http.FileServer(http.FS(fs))
@@ -94,22 +124,62 @@ func main() {
 		imageFS, _ := fs.Sub(embeddedFS, "assets")
 		router.StaticFS("/public", http.FS(imageFS))
 
-		v1 := router.Group("/v1")
+		// JWT_AUTH_ROUTES=all or LDAP_AUTH_ROUTES=all protect all the routes of /v1 (except the logins)
+		v1 := router.Group("/v1", routeAuth("all"))
 		{
 			v1.GET("/whoami", whoamiHandler)
 			v1.GET("/ping", pingHandler)
-			v1.GET("/echo", echoHandler)
-			v1.POST("/echo", echoHandler)
+			echoAuth := routeAuth("echo")
+			v1.Any("/echo", echoAuth, echoHandler)
+			v1.Any("/echo/*path", echoAuth, echoHandler)
 			v1.GET("/ldap", ldapHandler)
-			v1.GET("/db/:engine", dbEngineHandler)
-			v1.GET("/db/:engine/count/:table", dbHandlerCountRowTable)
+			v1.GET("/ldap/search", ldapSearchHandler)
+			v1.GET("/ldap/tls", ldapTLSHandler)
+			v1.GET("/ldap/groups", ldapGroupsHandler)
+			v1.GET("/ldap/health", ldapHealthHandler)
+			// the routes of LDAP_AUTH_ROUTES (echo, db, network) require a LDAP Basic authentication,
+			// the routes of JWT_AUTH_ROUTES require a JWT (one of them when the routes are in both)
+			db := v1.Group("/db", routeAuth("db"))
+			{
+				db.GET("", dbListHandler)
+				db.GET("/:engine", dbEngineHandler)
+				db.GET("/:engine/count/:table", dbHandlerCountRowTable)
+				db.GET("/:engine/query", dbQueryHandler)
+				db.GET("/:engine/bench", dbBenchHandler)
+				db.GET("/:engine/schemas", dbSchemasHandler)
+				db.GET("/:engine/tables", dbTablesHandler)
+				db.GET("/:engine/tables/:table/columns", dbColumnsHandler)
+				db.GET("/:engine/tables/:table/indexes", dbIndexesHandler)
+				db.GET("/target", dbTargetListHandler)
+				db.GET("/target/:name", dbTargetHandler)
+				db.GET("/target/:name/count/:table", dbTargetCountRowTableHandler)
+				db.GET("/target/:name/query", dbTargetQueryHandler)
+				db.GET("/target/:name/bench", dbBenchHandler)
+				db.GET("/target/:name/schemas", dbSchemasHandler)
+				db.GET("/target/:name/tables", dbTablesHandler)
+				db.GET("/target/:name/tables/:table/columns", dbColumnsHandler)
+				db.GET("/target/:name/tables/:table/indexes", dbIndexesHandler)
+			}
 			v1.GET("/healthcheck", healthcheckHandler)
 			v1.GET("/metrics", prometheusMetricsHandler)
 			v1.POST("/metrics", metricsHandler)
 			v1.GET("/url", testUrlHandler)
 			v1.POST("/jwt/login", jwtLoginHandler)
-			v1.GET("/jwt/test", jwtTestHandler)
-			v1.GET("/network", networkHandler)
+			v1.GET("/jwt/test", jwtRequire(nil, nil), jwtTestHandler)
+			v1.POST("/jwt/refresh", jwtRefreshHandler)
+			v1.POST("/jwt/revoke", jwtRevokeHandler)
+			v1.POST("/jwt/inspect", jwtInspectHandler)
+			v1.GET("/oidc/authorize", oidcAuthorizeHandler)
+			v1.POST("/oidc/authorize", oidcLoginHandler)
+			v1.POST("/oidc/token", oidcTokenHandler)
+			oidcUserinfo := jwtRequire(nil, []string{"openid"})
+			v1.GET("/oidc/userinfo", oidcUserinfo, oidcUserinfoHandler)
+			v1.POST("/oidc/userinfo", oidcUserinfo, oidcUserinfoHandler)
+			v1.GET("/oidc/test", oidcTestHandler)
+			v1.GET("/network", routeAuth("network"), networkHandler)
+			v1.GET("/admin/loglevel", logLevelHandler)
+			v1.PUT("/admin/loglevel", updateLogLevelHandler)
+			v1.POST("/admin/jwt/rotate", jwtRotateHandler)
 		}
 
 		// for example new group /v2 ...
@@ -131,10 +201,10 @@ func main() {
 
 		router.Run(":" + port)
 	case "batch":
-		switch strings.ToLower(job) {
-		case "metrics":
-			batchJobMetrics(argument)
-		}
+		os.Exit(runBatchJob(job, argument))
+	default:
+		l.Errorf("Unknown mode %s", mode)
+		os.Exit(batchExitInvalid)
 	}
 }
 
@@ -188,35 +258,6 @@ func pingHandler(c *gin.Context) {
 	}
 }
 
-// ---- swagger Informations
-// @Tags         Debugging
-// @router /v1/echo [post]
-// @summary Display the request in log
-// @consume application/json
-// @param request body string true "json"
-// @produce text/plain
-// @success 200 string OK
-func echoHandler(c *gin.Context) {
-	var statusCodeStr string
-	if len(c.Query("code")) > 0 && c.Query("code") != "200" {
-		statusCodeStr = c.Query("code")
-	}
-
-	statusCodeInt, err := strconv.Atoi(statusCodeStr)
-	if err != nil {
-		statusCodeInt = 200
-	}
-
-	params := c.Request.URL.Query()
-	log.Printf("[ECHO] query: %s", params)
-
-	if jsonData, err := ioutil.ReadAll(c.Request.Body); err == nil {
-		log.Printf("[ECHO] body: %s", string(jsonData))
-	}
-
-	c.String(statusCodeInt, "OK message received !")
-}
-
 // ---- swagger Informations
 // @Tags         Testing
 // @router /v1/whoami [get]
@@ -232,7 +273,7 @@ func whoamiHandler(c *gin.Context) {
 	wait := c.Query("wait")
 	if len(wait) > 0 {
 		duration, err := time.ParseDuration(wait)
-		log.Printf("[WHOAMI] wait to : %s", duration)
+		requestLogger(c, "WHOAMI").Debugf("wait to : %s", duration)
 		if err == nil {
 			time.Sleep(duration)
 		}
@@ -260,7 +301,7 @@ func whoamiHandler(c *gin.Context) {
 	_, _ = fmt.Fprintln(w, "RemoteAddr:", req.RemoteAddr)
 	if err := req.Write(w); err != nil {
 		c.String(http.StatusInternalServerError, "Errors")
-		log.Printf(err.Error())
+		requestLogger(c, "WHOAMI").Errorf("%s", err.Error())
 		return
 	}
 }
@@ -280,14 +321,15 @@ func healthcheckHandler(c *gin.Context) {
 	} else {
 		statusCodeStr = "200"
 	}
+	l := requestLogger(c, "HEALTHCHECK")
 	statusCodeInt, err := strconv.Atoi(statusCodeStr)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Errors")
-		log.Printf(err.Error())
+		l.Errorf("%s", err.Error())
 		return
 	}
 	if statusCodeInt > 200 {
-		log.Printf("Update health check status code [%d]\n", statusCodeInt)
+		l.Warnf("Update health check status code [%d]", statusCodeInt)
 	}
 	c.String(statusCodeInt, "Healthcheck return code: "+statusCodeStr)
 }
@@ -305,18 +347,49 @@ func testUrlHandler(c *gin.Context) {
 	if len(c.Query("test")) > 0 {
 		url = c.Query("test")
 	}
-	log.Printf("[URL] INFO : test=%s", url)
-	// post on url metrics
-	resp, err := http.Get(url)
+	resp, err := testURL(url, requestLogger(c, "URL"))
 	if err != nil {
 		c.String(http.StatusBadRequest, "Error sending request to "+url)
-		log.Printf("[URL] ERROR : " + err.Error())
 		return
 	}
-	log.Printf("[URL] INFO : Response Status: %s", resp.Status)
 	c.String(resp.StatusCode, url+" Return code : %s", resp.Status)
 }
 
+// testURL sends a GET request on url
+func testURL(url string, l *logger) (*http.Response, error) {
+	l.Infof("test=%s", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+	l.Infof("Response Status: %s", resp.Status)
+	return resp, nil
+}
+
+// function for Job
+func batchJobURL(argValues string) (interface{}, error) {
+	var data struct {
+		URL            string `json:"url"`
+		ExpectedStatus int    `json:"expected_status"`
+	}
+	data.URL = getenvs.GetEnvString("TEST_URL", "https://www.ecosia.org/")
+	data.ExpectedStatus = http.StatusOK
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		return nil, err
+	}
+	resp, err := testURL(data.URL, newLogger("BATCH/URL"))
+	if err != nil {
+		return nil, err
+	}
+	result := gin.H{"url": data.URL, "status": resp.StatusCode}
+	if resp.StatusCode != data.ExpectedStatus {
+		return result, fmt.Errorf("%s returned %s, expected %d", data.URL, resp.Status, data.ExpectedStatus)
+	}
+	return result, nil
+}
+
 // ---- swagger Informations, workarround for /metrics [get]
 // @Tags         Metrics
 // @router /v1/metrics [get]
@@ -340,7 +413,6 @@ func prometheusMetricsHandler(c *gin.Context) {
 // @failure 400 string Bad request
 // @failure 500 string Internal Server Error
 func metricsHandler(c *gin.Context) {
-	url := getenvs.GetEnvString("PUSHMETRICS_URL", "http://localhost:9091")
 	var data *jsonMetric = &jsonMetric{"macgover_server_job", "macgover_server_label", 1}
 	decoder := json.NewDecoder(c.Request.Body)
 	err := decoder.Decode(&data)
@@ -348,46 +420,51 @@ func metricsHandler(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Error reading body :"+err.Error())
 		return
 	}
-	log.Printf("[METRICS] INFO : parameters=%v", data)
-	log.Printf("[METRICS] INFO : url=%s", url)
-	// post on url metrics
-	urlToPostMetrics := url + "/metrics/job/" + strings.ReplaceAll(data.Job, " ", "") + "/" + strings.ReplaceAll(data.Label, " ", "") + "/" + strconv.Itoa(data.Value)
-	log.Printf("[METRICS] INFO : post on %s", urlToPostMetrics)
-	resp, err := http.Post(urlToPostMetrics, "", nil)
+	l := requestLogger(c, "METRICS")
+	l.Infof("parameters=%v", data)
+	resp, err := pushMetric(data, l)
 	if err != nil {
-		c.String(http.StatusBadRequest, "Error sending request to "+url)
-		log.Printf("[METRICS] ERROR : " + err.Error())
+		c.String(http.StatusBadRequest, "Error sending request to "+getenvs.GetEnvString("PUSHMETRICS_URL", "http://localhost:9091"))
 		return
 	}
-	log.Printf("[METRICS] INFO : Response Status: %s", resp.Status)
 	c.String(resp.StatusCode, "Return code : %s", resp.Status)
 }
 
-// function for Job
-func batchJobMetrics(argValues string) {
+// pushMetric posts the metric on the pushgateway (PUSHMETRICS_URL)
+func pushMetric(data *jsonMetric, l *logger) (*http.Response, error) {
 	url := getenvs.GetEnvString("PUSHMETRICS_URL", "http://localhost:9091")
-	var data *jsonMetric = &jsonMetric{"macgover_batch_job", "macgover_batch_label", 1}
-	err := json.Unmarshal([]byte(argValues), &data) // convert string to json
-	log.Printf("[BATCH/METRICS] INFO : argument=%v", data)
-	if err != nil {
-		log.Printf("[BATCH/METRICS] ERROR : json : %s", err.Error())
-		os.Exit(1)
-	}
-	log.Printf("[BATCH/METRICS] INFO : url=%s", url)
+	l.Debugf("url=%s", url)
 	// post on url metrics
 	urlToPostMetrics := url + "/metrics/job/" + strings.ReplaceAll(data.Job, " ", "") + "/" + strings.ReplaceAll(data.Label, " ", "") + "/" + strconv.Itoa(data.Value)
-	log.Printf("[BATCH/METRICS] INFO : post on %s", urlToPostMetrics)
+	l.Debugf("post on %s", urlToPostMetrics)
 	resp, err := http.Post(urlToPostMetrics, "", nil)
 	if err != nil {
-		log.Printf("[BATCH/METRICS] ERROR : " + err.Error())
-		os.Exit(1)
+		l.Errorf("%s", err.Error())
+		return nil, err
 	}
-	log.Printf("[BATCH/METRICS] INFO : Response Status: %s", resp.Status)
-	if resp.StatusCode == 200 {
-		os.Exit(0)
-	} else {
-		os.Exit(1)
+	defer resp.Body.Close()
+	l.Infof("Response Status: %s", resp.Status)
+	return resp, nil
+}
+
+// function for Job
+func batchJobMetrics(argValues string) (interface{}, error) {
+	l := newLogger("BATCH/METRICS")
+	var data *jsonMetric = &jsonMetric{"macgover_batch_job", "macgover_batch_label", 1}
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		l.Errorf("json : %s", err.Error())
+		return nil, err
+	}
+	l.Infof("argument=%v", data)
+	resp, err := pushMetric(data, l)
+	if err != nil {
+		return nil, err
+	}
+	result := gin.H{"job": data.Job, "label": data.Label, "value": data.Value, "status": resp.StatusCode}
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("pushgateway returned %s", resp.Status)
 	}
+	return result, nil
 }
 
 // ---- swagger Informations
@@ -402,8 +479,6 @@ func batchJobMetrics(argValues string) {
 // @success 200 string OK
 // @failure 500 string Internal Server Error
 func networkHandler(c *gin.Context) {
-	timeout := getenvs.GetEnvString("NETWORK_TIMEOUT", "5s")
-	ptimeout, _ := time.ParseDuration(timeout)
 	host := c.Query("host")
 	port := c.Query("port")
 	protocol := c.Query("protocol")
@@ -412,59 +487,111 @@ func networkHandler(c *gin.Context) {
 		protocol = "tcp"
 	}
 
-	log.Printf("[NETWORK] INFO : Parameters: host=%s, port=%s, protocol=%s, timeout=%s", host, port, protocol,timeout)
+	results, err := networkCheck(host, port, protocol, requestLogger(c, "NETWORK"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var resultConn []string
+	for _, r := range results {
+		if r.Connected {
+			resultConn = append(resultConn, fmt.Sprintf("Connection to %s on %s/%s is OK", r.Address, port, protocol))
+		} else {
+			resultConn = append(resultConn, fmt.Sprintf("Connection to %s on %s/%s is KO : %s", r.Address, port, protocol, r.Error))
+		}
+	}
+	c.String(http.StatusOK, "Checking "+host+" on "+port+"/"+protocol+" : \n"+strings.Join(resultConn, "\n"))
+}
+
+type networkResult struct {
+	Address   string `json:"address"`
+	Port      string `json:"port"`
+	Protocol  string `json:"protocol"`
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+// networkCheck resolves host and tries a connection on each ipv4 address
+func networkCheck(host string, port string, protocol string, l *logger) ([]networkResult, error) {
+	timeout := getenvs.GetEnvString("NETWORK_TIMEOUT", "5s")
+	ptimeout, _ := time.ParseDuration(timeout)
+
+	l.Debugf("Parameters: host=%s, port=%s, protocol=%s, timeout=%s", host, port, protocol, timeout)
 
 	testInputIP := net.ParseIP(host)
 	if testInputIP.To4() != nil {
 		addr, err := net.LookupAddr(host)
-		log.Printf("[NETWORK] INFO : DNS name = %s", addr)
+		l.Debugf("DNS name = %s", addr)
 		if err != nil {
-			log.Printf("[NETWORK] ERROR : dns : %s", err.Error())
+			l.Warnf("dns : %s", err.Error())
 		}
 	}
 
-	ip, err := net.LookupHost(host)
-	log.Printf("[NETWORK] INFO : ip address = %s", ip)
+	hosts, err := net.LookupHost(host)
+	l.Debugf("ip address = %s", hosts)
 	if err != nil {
-		log.Printf("[NETWORK] ERROR : ip : %s", err.Error())
-		c.String(http.StatusBadRequest, err.Error())
-	} else {
-		hosts := ip
-		var ipV4 []string
-	
-		testInputIPHost := net.ParseIP(host)
-		if testInputIPHost.To4() != nil { // ipv4 format
-			ipV4 = append(ipV4, host)
-		}
-	
-		for _, item := range hosts {
-			testInputIP := net.ParseIP(item)
-			if testInputIP.To4() != nil { // ipv4 format
-				if item != host {
-					ipV4 = append(ipV4, item)
-				}
-			}
-		}
-	
-		log.Printf("[NETWORK] Checking : %v", strings.Join(ipV4, ","))
-	
-		// host -> the remote host
-		// timeoutSecs -> the timeout value
-		var resultConn []string
-		for _, s := range ipV4 {
-			conn, err := net.DialTimeout(protocol, s+":"+port, ptimeout)
-			if err != nil {
-				log.Printf("[NETWORK] ERROR : " + err.Error())
-				resultConn = append(resultConn, fmt.Sprintf("Connection to %s on %s/%s is KO : %s", s, port, protocol, err.Error()))
-			} else {
-				conn.Close()
-				log.Printf("[NETWORK] Connection to %s on %s/%s is OK", s, port, protocol)
-				resultConn = append(resultConn, fmt.Sprintf("Connection to %s on %s/%s is OK", s, port, protocol))
+		l.Errorf("ip : %s", err.Error())
+		return nil, err
+	}
+
+	var ipV4 []string
+	if testInputIP.To4() != nil { // ipv4 format
+		ipV4 = append(ipV4, host)
+	}
+	for _, item := range hosts {
+		testInputIP := net.ParseIP(item)
+		if testInputIP.To4() != nil { // ipv4 format
+			if item != host {
+				ipV4 = append(ipV4, item)
 			}
 		}
-
-		c.String(http.StatusOK, "Checking "+host+" on "+port+"/"+protocol+" : \n"+strings.Join(resultConn, "\n"))
 	}
 
+	l.Infof("Checking : %v", strings.Join(ipV4, ","))
 
+	var results []networkResult
+	for _, s := range ipV4 {
+		result := networkResult{Address: s, Port: port, Protocol: protocol}
+		conn, err := net.DialTimeout(protocol, s+":"+port, ptimeout)
+		if err != nil {
+			l.Errorf("%s", err.Error())
+			result.Error = err.Error()
+		} else {
+			conn.Close()
+			l.Infof("Connection to %s on %s/%s is OK", s, port, protocol)
+			result.Connected = true
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// function for Job
+func batchJobNetwork(argValues string) (interface{}, error) {
+	var data struct {
+		Host     string `json:"host"`
+		Port     string `json:"port"`
+		Protocol string `json:"protocol"`
+	}
+	data.Protocol = "tcp"
+	if err := parseBatchArgument(argValues, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Host) == 0 || len(data.Port) == 0 {
+		return nil, fmt.Errorf("%w: host and port are required", errBatchArgument)
+	}
+	results, err := networkCheck(data.Host, data.Port, data.Protocol, newLogger("BATCH/NETWORK"))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		if !r.Connected {
+			return results, fmt.Errorf("connection to %s on %s/%s is KO", r.Address, r.Port, r.Protocol)
+		}
+	}
+	if len(results) == 0 {
+		return results, fmt.Errorf("no ipv4 address found for %s", data.Host)
+	}
+	return results, nil
 }
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+	getenvs "gitlab.com/avarf/getenvs"
+)
+
+// --------------------------- OIDC / OAuth2 client test
+
+// oidcTestRequest is the configuration of the test, OIDC_TEST_* variables by default
+type oidcTestRequest struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Scope        string `json:"scope"`
+	GrantType    string `json:"grant_type"` // client_credentials (default), password or authorization_code
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	RedirectURI  string `json:"redirect_uri"` // authorization_code
+	Audience     string `json:"audience"`     // audience of the access token (the client by default)
+}
+
+// oidcTestStep is the result of a step (discovery, jwks, token, access_token, id_token, userinfo)
+type oidcTestStep struct {
+	Name    string      `json:"name"`
+	Success bool        `json:"success"`
+	Latency string      `json:"latency,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type oidcTestResult struct {
+	Issuer    string         `json:"issuer"`
+	GrantType string         `json:"grant_type"`
+	Success   bool           `json:"success"`
+	Steps     []oidcTestStep `json:"steps"`
+}
+
+func init() {
+	registerBatchJob("oidctest", "discovery, JWKS, token grant and validation of the tokens of an OIDC issuer", `{"issuer": "https://idp.example.org/realms/test", "client_id": "macgover", "client_secret": "secret"}`, batchJobOIDCTest)
+}
+
+// oidcTestRequestFromEnv returns the configuration of OIDC_TEST_ISSUER, OIDC_TEST_CLIENT_ID, OIDC_TEST_CLIENT_SECRET,
+// OIDC_TEST_SCOPE (default openid), OIDC_TEST_REDIRECT_URI and OIDC_TEST_AUDIENCE
+func oidcTestRequestFromEnv() oidcTestRequest {
+	return oidcTestRequest{
+		Issuer:       os.Getenv("OIDC_TEST_ISSUER"),
+		ClientID:     os.Getenv("OIDC_TEST_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_TEST_CLIENT_SECRET"),
+		Scope:        getenvs.GetEnvString("OIDC_TEST_SCOPE", "openid"),
+		RedirectURI:  os.Getenv("OIDC_TEST_REDIRECT_URI"),
+		Audience:     os.Getenv("OIDC_TEST_AUDIENCE"),
+	}
+}
+
+// oidcTester runs the steps and keeps the documents of the issuer
+type oidcTester struct {
+	req       oidcTestRequest
+	client    *http.Client
+	l         *logger
+	result    *oidcTestResult
+	discovery oidcDiscovery
+	keys      jwks
+	// authorization_code : PKCE verifier, state and nonce of the authorization request, code of the redirection
+	verifier string
+	state    string
+	nonce    string
+	code     string
+}
+
+// step runs f, measures the latency and adds the result, the next steps are skipped when f fails
+func (t *oidcTester) step(name string, f func() (interface{}, error)) bool {
+	start := time.Now()
+	details, err := f()
+	step := oidcTestStep{Name: name, Success: err == nil, Latency: time.Since(start).String(), Details: details}
+	if err != nil {
+		step.Error = err.Error()
+		t.result.Success = false
+		t.l.Warnf("%s failed, %s", name, err.Error())
+	} else {
+		t.l.Infof("%s OK (%s)", name, step.Latency)
+	}
+	t.result.Steps = append(t.result.Steps, step)
+	return err == nil
+}
+
+// getJSON reads the JSON document of the URL
+func (t *oidcTester) getJSON(target string, header http.Header, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oidcTest runs the discovery, reads the JWKS, asks for the tokens and validates them
+func oidcTest(req oidcTestRequest, l *logger) (*oidcTestResult, error) {
+	req.Issuer = strings.TrimSuffix(req.Issuer, "/")
+	if len(req.Issuer) == 0 || len(req.ClientID) == 0 {
+		return nil, fmt.Errorf("%w: the issuer and the client_id are required (OIDC_TEST_ISSUER, OIDC_TEST_CLIENT_ID)", errBatchArgument)
+	}
+	if len(req.GrantType) == 0 && len(req.Username) == 0 {
+		req.GrantType = "client_credentials"
+	}
+	switch req.GrantType {
+	case "", "client_credentials", "password":
+	case "authorization_code":
+		if len(req.Username) == 0 || len(req.RedirectURI) == 0 {
+			return nil, fmt.Errorf("%w: the username and the redirect_uri are required with authorization_code", errBatchArgument)
+		}
+	default:
+		return nil, fmt.Errorf("%w: grant_type must be client_credentials, password or authorization_code", errBatchArgument)
+	}
+	l.Infof("issuer=%s client_id=%s grant_type=%s", req.Issuer, req.ClientID, req.GrantType)
+
+	t := &oidcTester{
+		req:    req,
+		client: &http.Client{Timeout: 10 * time.Second},
+		l:      l,
+		result: &oidcTestResult{Issuer: req.Issuer, GrantType: req.GrantType, Success: true, Steps: []oidcTestStep{}},
+	}
+	if !t.step("discovery", t.discover) || !t.step("jwks", t.fetchJWKS) {
+		return t.result, nil
+	}
+	if len(t.req.GrantType) == 0 {
+		// with a user : the password grant when the issuer supports it, the login form otherwise
+		t.req.GrantType = "authorization_code"
+		if jwtHasAll(t.discovery.GrantTypesSupported, []string{"password"}) || len(t.req.RedirectURI) == 0 {
+			t.req.GrantType = "password"
+		}
+		t.result.GrantType = t.req.GrantType
+	}
+	if t.req.GrantType == "authorization_code" && !t.step("authorize", t.authorize) {
+		return t.result, nil
+	}
+	var tokens jwtTokenResponse
+	if !t.step("token", func() (interface{}, error) { return t.requestTokens(&tokens) }) {
+		return t.result, nil
+	}
+	t.step("access_token", func() (interface{}, error) { return t.validate(tokens.AccessToken, false) })
+	if len(tokens.IDToken) > 0 {
+		t.step("id_token", func() (interface{}, error) { return t.validate(tokens.IDToken, true) })
+	} else if t.req.GrantType == "authorization_code" && jwtHasAll(strings.Fields(t.req.Scope), []string{"openid"}) {
+		t.step("id_token", func() (interface{}, error) { return nil, errors.New("no id_token in the response (scope openid)") })
+	}
+	if t.req.GrantType != "client_credentials" && len(t.discovery.UserinfoEndpoint) > 0 {
+		t.step("userinfo", func() (interface{}, error) {
+			var userinfo map[string]interface{}
+			header := http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}
+			return userinfo, t.getJSON(t.discovery.UserinfoEndpoint, header, &userinfo)
+		})
+	}
+	return t.result, nil
+}
+
+func (t *oidcTester) discover() (interface{}, error) {
+	if err := t.getJSON(t.req.Issuer+"/.well-known/openid-configuration", nil, &t.discovery); err != nil {
+		return nil, err
+	}
+	if t.discovery.Issuer != t.req.Issuer {
+		return t.discovery, fmt.Errorf("the issuer of the discovery document is %s", t.discovery.Issuer)
+	}
+	if len(t.discovery.TokenEndpoint) == 0 || len(t.discovery.JWKSURI) == 0 {
+		return t.discovery, errors.New("token_endpoint and jwks_uri are required")
+	}
+	return t.discovery, nil
+}
+
+func (t *oidcTester) fetchJWKS() (interface{}, error) {
+	if err := t.getJSON(t.discovery.JWKSURI, nil, &t.keys); err != nil {
+		return nil, err
+	}
+	kids := []string{}
+	for _, key := range t.keys.Keys {
+		kids = append(kids, key.Kid+" ("+key.Kty+" "+key.Alg+")")
+	}
+	if len(kids) == 0 {
+		return nil, errors.New("the JWKS has no key")
+	}
+	return gin.H{"keys": kids}, nil
+}
+
+// authorize signs in with the login form of the authorization endpoint (fields username and password, like
+// the form of the macgover provider) and reads the code of the redirection, with PKCE (S256), a state and a nonce
+func (t *oidcTester) authorize() (interface{}, error) {
+	if len(t.discovery.AuthorizationEndpoint) == 0 {
+		return nil, errors.New("no authorization_endpoint in the discovery document")
+	}
+	t.verifier, t.state, t.nonce = jwtNewID()+jwtNewID(), jwtNewID(), jwtNewID()
+	sum := sha256.Sum256([]byte(t.verifier))
+	form := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {t.req.ClientID},
+		"redirect_uri":          {t.req.RedirectURI},
+		"scope":                 {t.req.Scope},
+		"state":                 {t.state},
+		"nonce":                 {t.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"username":              {t.req.Username},
+		"password":              {t.req.Password},
+	}
+	// the redirection to the client is not followed
+	client := *t.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.PostForm(t.discovery.AuthorizationEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound && resp.StatusCode != http.StatusSeeOther {
+		return nil, fmt.Errorf("%s returned %d, the login form is not accepted", t.discovery.AuthorizationEndpoint, resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, err
+	}
+	query := location.Query()
+	details := gin.H{"redirect_uri": location.Scheme + "://" + location.Host + location.Path}
+	if len(query.Get("error")) > 0 {
+		return details, fmt.Errorf("%s (%s)", query.Get("error"), query.Get("error_description"))
+	}
+	if query.Get("state") != t.state {
+		return details, errors.New("the state of the redirection is not the state of the request")
+	}
+	if t.code = query.Get("code"); len(t.code) == 0 {
+		return details, errors.New("no code in the redirection")
+	}
+	return details, nil
+}
+
+// requestTokens runs the grant, the client is authenticated with client_secret_basic, or client_secret_post
+// when the issuer does not support client_secret_basic
+func (t *oidcTester) requestTokens(tokens *jwtTokenResponse) (interface{}, error) {
+	form := url.Values{"grant_type": {t.req.GrantType}}
+	if len(t.req.Scope) > 0 {
+		form.Set("scope", t.req.Scope)
+	}
+	switch t.req.GrantType {
+	case "password":
+		form.Set("username", t.req.Username)
+		form.Set("password", t.req.Password)
+	case "authorization_code":
+		form.Del("scope")
+		form.Set("code", t.code)
+		form.Set("redirect_uri", t.req.RedirectURI)
+		form.Set("code_verifier", t.verifier)
+	}
+	methods := t.discovery.TokenEndpointAuthMethodsSupported
+	basic := jwtHasAll(methods, []string{"client_secret_basic"}) || !jwtHasAll(methods, []string{"client_secret_post"})
+	if !basic || len(t.req.ClientSecret) == 0 {
+		form.Set("client_id", t.req.ClientID)
+		if len(t.req.ClientSecret) > 0 {
+			form.Set("client_secret", t.req.ClientSecret)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, t.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basic && len(t.req.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(t.req.ClientID), url.QueryEscape(t.req.ClientSecret))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// the body is the error of the issuer (error, error_description)
+		var oauthError map[string]interface{}
+		json.Unmarshal(body, &oauthError)
+		return oauthError, fmt.Errorf("%s returned %d", t.discovery.TokenEndpoint, resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, tokens); err != nil {
+		return nil, err
+	}
+	if len(tokens.AccessToken) == 0 {
+		return nil, errors.New("no access_token in the response")
+	}
+	// the tokens are not returned, only their presence
+	return gin.H{
+		"token_type":    tokens.TokenType,
+		"expires_in":    tokens.ExpiresIn,
+		"scope":         tokens.Scope,
+		"refresh_token": len(tokens.RefreshToken) > 0,
+		"id_token":      len(tokens.IDToken) > 0,
+	}, nil
+}
+
+// validate checks the signature with the JWKS, the dates and the issuer of the token, and the audience : the client
+// (and the nonce) for the id_token, the audience of the request or the client (aud, azp or client_id) for the access
+// token, an opaque access token is not validated
+func (t *oidcTester) validate(tokenString string, idToken bool) (interface{}, error) {
+	if strings.Count(tokenString, ".") != 2 {
+		if !idToken {
+			return gin.H{"format": "opaque"}, nil
+		}
+		return nil, errors.New("the token is not a JWT")
+	}
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range t.keys.Keys {
+			if key.Kid == kid && len(key.Alg) > 0 && key.Alg != token.Method.Alg() {
+				return nil, fmt.Errorf("the algorithm %s is not the one of the key %s", token.Method.Alg(), key.Alg)
+			}
+		}
+		return t.keys.publicKey(kid)
+	})
+	details := gin.H{"format": "JWT"}
+	if token != nil {
+		details["alg"] = token.Header["alg"]
+		details["kid"] = token.Header["kid"]
+	}
+	for _, name := range []string{"iss", "sub", "aud", "exp", "scope", "azp", "client_id"} {
+		if value, ok := claims[name]; ok {
+			details[name] = value
+		}
+	}
+	if err != nil {
+		return details, err
+	}
+	if !claims.VerifyIssuer(t.req.Issuer, true) {
+		return details, fmt.Errorf("the issuer is not %s", t.req.Issuer)
+	}
+	switch {
+	case idToken:
+		if !claims.VerifyAudience(t.req.ClientID, true) {
+			return details, fmt.Errorf("the audience is not %s", t.req.ClientID)
+		}
+		if nonce, _ := claims["nonce"].(string); len(t.nonce) > 0 && nonce != t.nonce {
+			return details, errors.New("the nonce is not the nonce of the authorization request")
+		}
+	case len(t.req.Audience) > 0:
+		if !claims.VerifyAudience(t.req.Audience, true) {
+			return details, fmt.Errorf("the audience is not %s", t.req.Audience)
+		}
+	default:
+		azp, _ := claims["azp"].(string)
+		clientID, _ := claims["client_id"].(string)
+		if !claims.VerifyAudience(t.req.ClientID, true) && azp != t.req.ClientID && clientID != t.req.ClientID {
+			return details, fmt.Errorf("the token is not issued to %s (aud, azp or client_id)", t.req.ClientID)
+		}
+	}
+	return details, nil
+}
+
+// ---- swagger Informations
+// @Tags         Endpoints
+// @router /v1/oidc/test [get]
+// @summary Test an OIDC issuer : discovery, JWKS, token (client_credentials, or password / authorization_code with the Basic authentication) and validation of the tokens
+// @security BasicAuth
+// @param issuer query string false "issuer (OIDC_TEST_ISSUER by default)"
+// @param client_id query string false "client (OIDC_TEST_CLIENT_ID by default)"
+// @param scope query string false "scope (OIDC_TEST_SCOPE by default)"
+// @param grant_type query string false "client_credentials, password or authorization_code"
+// @param redirect_uri query string false "redirect URI of the client for authorization_code (OIDC_TEST_REDIRECT_URI by default)"
+// @param audience query string false "audience of the access token (OIDC_TEST_AUDIENCE by default, the client otherwise)"
+// @produce application/json
+// @success 200 {object} oidcTestResult
+// @failure 400 string Bad Request
+// @failure 503 {object} oidcTestResult
+func oidcTestHandler(c *gin.Context) {
+	req := oidcTestRequestFromEnv()
+	if issuer := c.Query("issuer"); len(issuer) > 0 {
+		req.Issuer = issuer
+	}
+	if clientID := c.Query("client_id"); len(clientID) > 0 {
+		req.ClientID = clientID
+	}
+	if scope := c.Query("scope"); len(scope) > 0 {
+		req.Scope = scope
+	}
+	if redirectURI := c.Query("redirect_uri"); len(redirectURI) > 0 {
+		req.RedirectURI = redirectURI
+	}
+	if audience := c.Query("audience"); len(audience) > 0 {
+		req.Audience = audience
+	}
+	req.GrantType = c.Query("grant_type")
+	// the password and authorization_code grants are used with the Basic authentication
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		req.Username, req.Password = username, password
+	}
+	result, err := oidcTest(req, requestLogger(c, "OIDC/TEST"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if !result.Success {
+		c.JSON(http.StatusServiceUnavailable, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// function for Job
+func batchJobOIDCTest(argValues string) (interface{}, error) {
+	req := oidcTestRequestFromEnv()
+	if err := parseBatchArgument(argValues, &req); err != nil {
+		return nil, err
+	}
+	result, err := oidcTest(req, newLogger("BATCH/OIDC"))
+	if err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		for _, step := range result.Steps {
+			if !step.Success {
+				return result, fmt.Errorf("%s failed, %s", step.Name, step.Error)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// oidcTestSteps returns the name and the success of the steps (name:ok or name:error)
+func oidcTestSteps(result *oidcTestResult) string {
+	steps := []string{}
+	for _, step := range result.Steps {
+		status := "ok"
+		if !step.Success {
+			status = step.Error
+		}
+		steps = append(steps, step.Name+":"+status)
+	}
+	return strings.Join(steps, " ")
+}
+
+// oidcTestAllOK returns true when all the steps are ok
+func oidcTestAllOK(steps string) bool {
+	return strings.Count(steps, ":ok") == strings.Count(steps, ":")
+}
+
+// the tester signs in with the login form of the provider of macgover (authorization code flow with PKCE)
+func TestOIDCTestProvider(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newLogger("TEST")
+	initJWTKeys()
+	saved := jwtKeys
+	jwtKeys = &jwtKeyRing{alg: "ES256"}
+	defer func() { jwtKeys = saved }()
+	if err := jwtKeys.rotate(l); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.SetHTMLTemplate(template.Must(template.New("").ParseFS(embeddedFS, "templates/*.tmpl")))
+	router.GET("/.well-known/openid-configuration", oidcDiscoveryHandler)
+	router.GET("/.well-known/jwks.json", jwksHandler)
+	router.POST("/v1/oidc/authorize", oidcLoginHandler)
+	router.POST("/v1/oidc/token", oidcTokenHandler)
+	router.GET("/v1/oidc/userinfo", jwtRequire(nil, []string{"openid"}), oidcUserinfoHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	redirectURI := "http://localhost:8080/callback"
+	t.Setenv("OIDC_ISSUER", server.URL)
+	t.Setenv("OIDC_CLIENTS", "myapp:{PLAIN}s3cret="+redirectURI)
+	t.Setenv("JWT_USER_STORE", "env")
+	t.Setenv("JWT_USERS", "alice:{PLAIN}pa55")
+
+	tests := []struct {
+		name     string
+		grant    string
+		password string
+		audience string
+		want     string
+	}{
+		{name: "authorization code", grant: "authorization_code", password: "pa55",
+			want: "discovery:ok jwks:ok authorize:ok token:ok access_token:ok id_token:ok userinfo:ok"},
+		{name: "default grant with a user", password: "pa55",
+			want: "discovery:ok jwks:ok authorize:ok token:ok access_token:ok id_token:ok userinfo:ok"},
+		{name: "wrong password", grant: "authorization_code", password: "wrong",
+			want: "discovery:ok jwks:ok authorize:" + server.URL + "/v1/oidc/authorize returned 401, the login form is not accepted"},
+		{name: "audience of the access token", grant: "authorization_code", password: "pa55", audience: "macgover",
+			want: "discovery:ok jwks:ok authorize:ok token:ok access_token:ok id_token:ok userinfo:ok"},
+		{name: "wrong audience of the access token", grant: "authorization_code", password: "pa55", audience: "api",
+			want: "discovery:ok jwks:ok authorize:ok token:ok access_token:the audience is not api id_token:ok userinfo:ok"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := oidcTest(oidcTestRequest{
+				Issuer: server.URL, ClientID: "myapp", ClientSecret: "s3cret", Scope: "openid profile", GrantType: test.grant,
+				Username: "alice", Password: test.password, RedirectURI: redirectURI, Audience: test.audience,
+			}, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := oidcTestSteps(result); got != test.want {
+				t.Fatalf("steps %s, %s expected", got, test.want)
+			}
+			if result.Success != oidcTestAllOK(test.want) || result.GrantType != "authorization_code" {
+				t.Fatalf("success %v (grant %s)", result.Success, result.GrantType)
+			}
+		})
+	}
+}
+
+// mock IdP : client_credentials grant, the claims of the access token are chosen by the test
+func TestOIDCTestTokenValidation(t *testing.T) {
+	l := newLogger("TEST")
+	ring := &jwtKeyRing{alg: "ES256"}
+	if err := ring.rotate(l); err != nil {
+		t.Fatal(err)
+	}
+	key := ring.keys[0]
+	var claims jwt.MapClaims
+	var idTokenClaims jwt.MapClaims
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{Issuer: server.URL, TokenEndpoint: server.URL + "/token", JWKSURI: server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ring.jwks())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "macgover" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sign := func(claims jwt.MapClaims) string {
+			token := jwt.NewWithClaims(key.method, claims)
+			token.Header["kid"] = key.kid
+			signed, _ := token.SignedString(key.private)
+			return signed
+		}
+		response := jwtTokenResponse{AccessToken: sign(claims), TokenType: "Bearer", ExpiresIn: 60}
+		if idTokenClaims != nil {
+			response.IDToken = sign(idTokenClaims)
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+
+	exp := time.Now().Add(time.Minute).Unix()
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		idToken  jwt.MapClaims
+		audience string
+		want     string
+	}{
+		{name: "aud", claims: jwt.MapClaims{"iss": server.URL, "aud": "macgover", "exp": exp}, want: "access_token:ok"},
+		{name: "azp", claims: jwt.MapClaims{"iss": server.URL, "aud": "account", "azp": "macgover", "exp": exp}, want: "access_token:ok"},
+		{name: "client_id", claims: jwt.MapClaims{"iss": server.URL, "aud": "macgover", "client_id": "macgover", "exp": exp}, want: "access_token:ok"},
+		{name: "audience of the request", claims: jwt.MapClaims{"iss": server.URL, "aud": []string{"api", "other"}, "exp": exp}, audience: "api", want: "access_token:ok"},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://evil.example.com", "aud": "macgover", "exp": exp},
+			want: "access_token:the issuer is not " + server.URL},
+		{name: "no issuer", claims: jwt.MapClaims{"aud": "macgover", "exp": exp}, want: "access_token:the issuer is not " + server.URL},
+		{name: "other client", claims: jwt.MapClaims{"iss": server.URL, "aud": "account", "azp": "other", "exp": exp},
+			want: "access_token:the token is not issued to macgover (aud, azp or client_id)"},
+		{name: "wrong audience of the request", claims: jwt.MapClaims{"iss": server.URL, "aud": "macgover", "exp": exp}, audience: "api",
+			want: "access_token:the audience is not api"},
+		{name: "expired", claims: jwt.MapClaims{"iss": server.URL, "aud": "macgover", "exp": time.Now().Add(-time.Minute).Unix()},
+			want: "access_token:Token is expired"},
+		{name: "id_token of another client", claims: jwt.MapClaims{"iss": server.URL, "aud": "macgover", "exp": exp},
+			idToken: jwt.MapClaims{"iss": server.URL, "aud": "other", "exp": exp}, want: "access_token:ok id_token:the audience is not macgover"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, idTokenClaims = test.claims, test.idToken
+			result, err := oidcTest(oidcTestRequest{Issuer: server.URL + "/", ClientID: "macgover", ClientSecret: "secret", Audience: test.audience}, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := oidcTestSteps(result); got != "discovery:ok jwks:ok token:ok "+test.want {
+				t.Fatalf("steps %s, %s expected", got, test.want)
+			}
+			if result.Success != oidcTestAllOK(test.want) {
+				t.Fatalf("success %v", result.Success)
+			}
+		})
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	jwt "github.com/golang-jwt/jwt/v4"
+	getenvs "gitlab.com/avarf/getenvs"
+	"gopkg.in/yaml.v3"
+)
+
+// --------------------------- OpenID Connect provider (authorization code flow with PKCE)
+
+// oidcCodeTTL is the lifetime of the authorization codes
+const oidcCodeTTL = time.Minute
+
+// oidcScopes are the scopes granted to all the users, the other scopes requested must be in JWT_USER_SCOPES
+var oidcScopes = []string{"openid", "profile", "offline_access"}
+
+// oidcClient is a client registered in OIDC_CLIENTS or OIDC_CLIENTS_FILE, the public clients (without secret)
+// must use PKCE
+type oidcClient struct {
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"` // bcrypt hash, {SHA} or {PLAIN}
+	RedirectURIs []string `yaml:"redirect_uris"`
+}
+
+// oidcAuthorizeRequest is the request of the client to /v1/oidc/authorize
+type oidcAuthorizeRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	Nonce               string `form:"nonce"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+}
+
+// oidcIDToken is the id_token returned to the client
+type oidcIDToken struct {
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
+	Roles             []string         `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// oidcDiscovery is the document /.well-known/openid-configuration
+type oidcDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// oidcEnabled returns true when clients are registered
+func oidcEnabled() bool {
+	return len(os.Getenv("OIDC_CLIENTS")) > 0 || len(os.Getenv("OIDC_CLIENTS_FILE")) > 0
+}
+
+// oidcClients reads the clients of OIDC_CLIENTS (client_id:secret=redirect_uri1 redirect_uri2,...) and of
+// the YAML file OIDC_CLIENTS_FILE
+func oidcClients() (map[string]oidcClient, error) {
+	clients := map[string]oidcClient{}
+	for _, item := range strings.Split(os.Getenv("OIDC_CLIENTS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		credentials := strings.SplitN(parts[0], ":", 2)
+		client := oidcClient{ClientID: credentials[0], RedirectURIs: strings.Fields(parts[1])}
+		if len(credentials) == 2 {
+			client.ClientSecret = credentials[1]
+		}
+		clients[client.ClientID] = client
+	}
+
+	if file := os.Getenv("OIDC_CLIENTS_FILE"); len(file) > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		var content struct {
+			Clients []oidcClient `yaml:"clients"`
+		}
+		if err := yaml.NewDecoder(f).Decode(&content); err != nil {
+			return nil, err
+		}
+		for _, client := range content.Clients {
+			clients[client.ClientID] = client
+		}
+	}
+	return clients, nil
+}
+
+// errOIDCIssuer is returned when the provider is enabled without OIDC_ISSUER
+var errOIDCIssuer = errors.New("OIDC_ISSUER is required (https://host:port of the provider)")
+
+// oidcIssuer returns OIDC_ISSUER, the issuer is not built from the Host and X-Forwarded-* headers of the
+// request because the client controls them
+func oidcIssuer() (string, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if len(issuer) == 0 {
+		return "", errOIDCIssuer
+	}
+	if u, err := url.Parse(issuer); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return "", fmt.Errorf("OIDC_ISSUER : invalid URL %s", issuer)
+	}
+	return issuer, nil
+}
+
+// oidcPKCEMethods returns the code_challenge_method accepted, plain only with OIDC_PKCE_PLAIN=true
+func oidcPKCEMethods() []string {
+	if plain, _ := getenvs.GetEnvBool("OIDC_PKCE_PLAIN", false); plain {
+		return []string{"S256", "plain"}
+	}
+	return []string{"S256"}
+}
+
+// oidcGrantedScope returns the scopes requested which are granted to the user (oidcScopes and JWT_USER_SCOPES)
+func oidcGrantedScope(requested string, username string) string {
+	allowed := append(append([]string{}, oidcScopes...), jwtUserClaims("JWT_USER_SCOPES", username)...)
+	granted := []string{}
+	for _, scope := range strings.Fields(requested) {
+		if jwtHasAll(allowed, []string{scope}) && !jwtHasAll(granted, []string{scope}) {
+			granted = append(granted, scope)
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+// --------------------------- authorization codes
+
+type oidcCode struct {
+	request    oidcAuthorizeRequest
+	username   string
+	authTime   time.Time
+	expiration time.Time
+}
+
+type oidcCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]*oidcCode
+}
+
+var oidcCodes = &oidcCodeStore{codes: map[string]*oidcCode{}}
+
+func (s *oidcCodeStore) add(request oidcAuthorizeRequest, username string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, c := range s.codes {
+		if now.After(c.expiration) {
+			delete(s.codes, id)
+		}
+	}
+	s.codes[code] = &oidcCode{request: request, username: username, authTime: now, expiration: now.Add(oidcCodeTTL)}
+	return code
+}
+
+// take returns the code (nil when it is unknown or expired), a code is used only once
+func (s *oidcCodeStore) take(code string) *oidcCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.codes[code]
+	if !ok {
+		return nil
+	}
+	delete(s.codes, code)
+	if time.Now().After(c.expiration) {
+		return nil
+	}
+	return c
+}
+
+// oidcVerifyPKCE checks the code_verifier with the code_challenge (RFC 7636)
+func oidcVerifyPKCE(request oidcAuthorizeRequest, verifier string) bool {
+	if len(request.CodeChallenge) == 0 {
+		return true
+	}
+	challenge := verifier
+	if request.CodeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return len(verifier) > 0 && subtle.ConstantTimeCompare([]byte(challenge), []byte(request.CodeChallenge)) == 1
+}
+
+// --------------------------- authorization endpoint
+
+// oidcValidateRequest checks the request, the page is displayed with the message when the client or the
+// redirect_uri is wrong, the client is redirected with the error code otherwise
+func oidcValidateRequest(req *oidcAuthorizeRequest) (message string, code string, description string) {
+	clients, err := oidcClients()
+	if err != nil {
+		return "the OIDC clients are not readable", "", ""
+	}
+	client, ok := clients[req.ClientID]
+	if !ok {
+		return "unknown client_id", "", ""
+	}
+	if len(req.RedirectURI) == 0 && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !jwtHasAll(client.RedirectURIs, []string{req.RedirectURI}) {
+		return "the redirect_uri is not registered for the client", "", ""
+	}
+	if _, err := url.Parse(req.RedirectURI); err != nil {
+		return "invalid redirect_uri", "", ""
+	}
+	if req.ResponseType != "code" {
+		return "", "unsupported_response_type", "only the authorization code flow (code) is supported"
+	}
+	if !jwtHasAll(strings.Fields(req.Scope), []string{"openid"}) {
+		return "", "invalid_scope", "the scope openid is required"
+	}
+	if len(req.CodeChallenge) > 0 && len(req.CodeChallengeMethod) == 0 {
+		req.CodeChallengeMethod = "plain"
+	}
+	if len(req.CodeChallenge) > 0 && !jwtHasAll(oidcPKCEMethods(), []string{req.CodeChallengeMethod}) {
+		return "", "invalid_request", "code_challenge_method must be " + strings.Join(oidcPKCEMethods(), " or ")
+	}
+	if len(client.ClientSecret) == 0 && len(req.CodeChallenge) == 0 {
+		return "", "invalid_request", "code_challenge is required for the public clients (PKCE)"
+	}
+	return "", "", ""
+}
+
+// oidcRedirect redirects to the redirect_uri of the client with the parameters and the state
+func oidcRedirect(c *gin.Context, req oidcAuthorizeRequest, params url.Values) {
+	u, _ := url.Parse(req.RedirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if len(req.State) > 0 {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, u.String())
+}
+
+func oidcLoginPage(c *gin.Context, status int, req oidcAuthorizeRequest, message string) {
+	c.HTML(status, "oidc_login.tmpl", gin.H{
+		"title":   "Macgover - Sign in",
+		"request": req,
+		"error":   message,
+	})
+}
+
+// ---- swagger Informations
+// @Tags         OIDC
+// @router /v1/oidc/authorize [get]
+// @summary Authorization endpoint (authorization code flow with PKCE), display the login form
+// @param response_type query string true "code"
+// @param client_id query string true "client registered in OIDC_CLIENTS or OIDC_CLIENTS_FILE"
+// @param redirect_uri query string false "redirect URI registered for the client"
+// @param scope query string true "openid profile ..."
+// @param state query string false "state returned to the client"
+// @param nonce query string false "nonce of the id_token"
+// @param code_challenge query string false "PKCE challenge (required for the public clients)"
+// @param code_challenge_method query string false "S256 (plain with OIDC_PKCE_PLAIN=true)"
+// @produce text/html
+// @success 200 string OK
+// @failure 302 string Redirection to the client with an error
+// @failure 400 string Bad Request
+func oidcAuthorizeHandler(c *gin.Context) {
+	var req oidcAuthorizeRequest
+	c.ShouldBindWith(&req, binding.Form)
+	if message, code, description := oidcValidateRequest(&req); len(message) > 0 {
+		requestLogger(c, "OIDC/AUTHORIZE").Warnf("%s (client_id=%s)", message, req.ClientID)
+		oidcLoginPage(c, http.StatusBadRequest, oidcAuthorizeRequest{}, message)
+		return
+	} else if len(code) > 0 {
+		oidcRedirect(c, req, url.Values{"error": {code}, "error_description": {description}})
+		return
+	}
+	oidcLoginPage(c, http.StatusOK, req, "")
+}
+
+// ---- swagger Informations
+// @Tags         OIDC
+// @router /v1/oidc/authorize [post]
+// @summary Check the credentials of the login form (JWT_USER_STORE) and redirect to the client with the code
+// @consume application/x-www-form-urlencoded
+// @param username formData string true "user"
+// @param password formData string true "password"
+// @produce text/html
+// @success 302 string Redirection to the client with the code
+// @failure 400 string Bad Request
+// @failure 401 string Unauthorized
+func oidcLoginHandler(c *gin.Context) {
+	l := requestLogger(c, "OIDC/AUTHORIZE")
+	var req oidcAuthorizeRequest
+	c.ShouldBindWith(&req, binding.Form)
+	if message, code, description := oidcValidateRequest(&req); len(message) > 0 {
+		l.Warnf("%s (client_id=%s)", message, req.ClientID)
+		oidcLoginPage(c, http.StatusBadRequest, oidcAuthorizeRequest{}, message)
+		return
+	} else if len(code) > 0 {
+		oidcRedirect(c, req, url.Values{"error": {code}, "error_description": {description}})
+		return
+	}
+
+	username := c.PostForm("username")
+	if err := jwtAuthenticate(username, c.PostForm("password"), l); err != nil {
+		if errors.Is(err, errJWTUnauthorized) {
+			oidcLoginPage(c, http.StatusUnauthorized, req, "Invalid username or password")
+			return
+		}
+		oidcLoginPage(c, http.StatusInternalServerError, req, "The authentication failed, see the logs")
+		return
+	}
+	l.Infof("%s signed in for the client %s", username, req.ClientID)
+	oidcRedirect(c, req, url.Values{"code": {oidcCodes.add(req, username)}})
+}
+
+// --------------------------- token endpoint
+
+// oidcTokenError returns the error of the token endpoint (RFC 6749)
+func oidcTokenError(c *gin.Context, status int, code string, description string) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// oidcAuthenticateClient checks the client with the Basic authentication (client_secret_basic), the form
+// (client_secret_post) or without secret for the public clients (none)
+func oidcAuthenticateClient(c *gin.Context) (*oidcClient, error) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	if ok {
+		// the credentials are form-urlencoded (RFC 6749 2.3.1)
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	clients, err := oidcClients()
+	if err != nil {
+		return nil, err
+	}
+	client, found := clients[clientID]
+	if !found {
+		return nil, fmt.Errorf("%w (unknown client %s)", errJWTUnauthorized, clientID)
+	}
+	if len(client.ClientSecret) > 0 {
+		ok, err := jwtCheckPassword(client.ClientSecret, secret)
+		if err != nil {
+			return nil, fmt.Errorf("%w (client %s, %s)", errJWTUnauthorized, clientID, err.Error())
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w (client %s)", errJWTUnauthorized, clientID)
+		}
+	}
+	return &client, nil
+}
+
+// oidcIssueTokens signs the access, refresh and id tokens of the user for the client
+func oidcIssueTokens(clientID string, username string, scope string, nonce string, authTime time.Time) (*jwtTokenResponse, error) {
+	issuer, err := oidcIssuer()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := jwtIssueTokens(username, func(claims *Token) {
+		claims.Issuer = issuer
+		claims.Scope = scope
+		claims.ClientID = clientID
+	})
+	if err != nil {
+		return nil, err
+	}
+	tokens.Scope = scope
+
+	now := time.Now()
+	idToken := oidcIDToken{
+		Nonce: nonce,
+		Roles: jwtUserClaims("JWT_USER_ROLES", username),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   username,
+			Audience:  jwt.ClaimStrings{clientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(tokens.ExpiresIn) * time.Second)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jwtNewID(),
+		},
+	}
+	if !authTime.IsZero() {
+		idToken.AuthTime = jwt.NewNumericDate(authTime)
+	}
+	if jwtHasAll(strings.Fields(scope), []string{"profile"}) {
+		idToken.PreferredUsername = username
+	}
+	if tokens.IDToken, err = jwtSign(idToken); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// ---- swagger Informations
+// @Tags         OIDC
+// @router /v1/oidc/token [post]
+// @summary Token endpoint : exchange an authorization code (grant_type=authorization_code) or a refresh token (grant_type=refresh_token) for the tokens
+// @consume application/x-www-form-urlencoded
+// @param grant_type formData string true "authorization_code or refresh_token"
+// @param code formData string false "authorization code"
+// @param redirect_uri formData string false "redirect URI of the authorization request (required with authorization_code)"
+// @param code_verifier formData string false "PKCE verifier"
+// @param refresh_token formData string false "refresh token"
+// @param client_id formData string false "client (without Basic authentication)"
+// @param client_secret formData string false "secret of the client (without Basic authentication)"
+// @produce application/json
+// @success 200 {object} jwtTokenResponse
+// @failure 400 string Bad Request
+// @failure 401 string Unauthorized
+// @failure 500 string Internal Server Error
+func oidcTokenHandler(c *gin.Context) {
+	l := requestLogger(c, "OIDC/TOKEN")
+	client, err := oidcAuthenticateClient(c)
+	if err != nil {
+		if !errors.Is(err, errJWTUnauthorized) {
+			l.Errorf("%s", err.Error())
+			oidcTokenError(c, http.StatusInternalServerError, "server_error", "the OIDC clients are not readable")
+			return
+		}
+		l.Warnf("client authentication failed, %s", err.Error())
+		c.Header("WWW-Authenticate", `Basic realm="Macgover"`)
+		oidcTokenError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	var tokens *jwtTokenResponse
+	switch grantType := c.PostForm("grant_type"); grantType {
+	case "authorization_code":
+		code := oidcCodes.take(c.PostForm("code"))
+		if code == nil || code.request.ClientID != client.ClientID {
+			oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "the code is invalid, expired or already used")
+			return
+		}
+		if len(c.PostForm("redirect_uri")) == 0 {
+			oidcTokenError(c, http.StatusBadRequest, "invalid_request", "the redirect_uri is required")
+			return
+		}
+		if c.PostForm("redirect_uri") != code.request.RedirectURI {
+			oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "the redirect_uri does not match")
+			return
+		}
+		if !oidcVerifyPKCE(code.request, c.PostForm("code_verifier")) {
+			oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "the code_verifier does not match the code_challenge")
+			return
+		}
+		scope := oidcGrantedScope(code.request.Scope, code.username)
+		tokens, err = oidcIssueTokens(client.ClientID, code.username, scope, code.request.Nonce, code.authTime)
+
+	case "refresh_token":
+		token, parseErr := jwtParseToken(c.PostForm("refresh_token"), jwtRefreshToken)
+		if parseErr == nil && token.Claims.(*Token).ClientID != client.ClientID {
+			parseErr = errors.New("the token belongs to another client")
+		}
+		if parseErr != nil || !token.Valid {
+			l.Warnf("refresh refused, %v", parseErr)
+			oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid, expired or revoked")
+			return
+		}
+		claims := token.Claims.(*Token)
+		if err := jwtDenied.revokeIfAbsent(claims.ID, claims.ExpiresAt.Time, l); errors.Is(err, errJWTRevoked) {
+			l.Warnf("refresh refused, the refresh token %s of %s is already used", claims.ID, claims.Username)
+			oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid, expired or revoked")
+			return
+		} else if err != nil {
+			oidcTokenError(c, http.StatusInternalServerError, "server_error", "the refresh token cannot be revoked")
+			return
+		}
+		tokens, err = oidcIssueTokens(client.ClientID, claims.Username, claims.Scope, "", time.Time{})
+
+	default:
+		oidcTokenError(c, http.StatusBadRequest, "unsupported_grant_type", "authorization_code or refresh_token expected")
+		return
+	}
+	if err != nil {
+		l.Errorf("%s", err.Error())
+		oidcTokenError(c, http.StatusInternalServerError, "server_error", "the tokens cannot be signed, see the logs")
+		return
+	}
+	l.Infof("tokens issued to the client %s", client.ClientID)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, tokens)
+}
+
+// ---- swagger Informations
+// @Tags         OIDC
+// @router /v1/oidc/userinfo [get]
+// @summary Claims of the user of the access token (scope openid required)
+// @security BearerAuth
+// @produce application/json
+// @success 200 string OK
+// @failure 401 string Unauthorized
+// @failure 403 string Forbidden
+func oidcUserinfoHandler(c *gin.Context) {
+	// the token is validated by the middleware jwtRequire
+	claims := jwtClaims(c)
+	if claims == nil {
+		c.Writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	userinfo := gin.H{"sub": claims.Subject}
+	if jwtHasAll(strings.Fields(claims.Scope), []string{"profile"}) {
+		userinfo["preferred_username"] = claims.Username
+		userinfo["name"] = claims.Username
+	}
+	if len(claims.Roles) > 0 {
+		userinfo["roles"] = claims.Roles
+	}
+	c.JSON(http.StatusOK, userinfo)
+}
+
+// ---- swagger Informations
+// @Tags         OIDC
+// @router /.well-known/openid-configuration [get]
+// @summary OpenID Connect discovery document
+// @produce application/json
+// @success 200 {object} oidcDiscovery
+// @failure 500 string Internal Server Error
+func oidcDiscoveryHandler(c *gin.Context) {
+	issuer, err := oidcIssuer()
+	if err != nil {
+		requestLogger(c, "OIDC").Errorf("%s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	algs := []string{}
+	if method, _, _, err := jwtKeys.signer(); err == nil {
+		algs = append(algs, method.Alg())
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, oidcDiscovery{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/v1/oidc/authorize",
+		TokenEndpoint:                     issuer + "/v1/oidc/token",
+		UserinfoEndpoint:                  issuer + "/v1/oidc/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algs,
+		ScopesSupported:                   oidcScopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     oidcPKCEMethods(),
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "name", "roles"},
+	})
+}
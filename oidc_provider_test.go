@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// oidcTestRouter returns the routes of the provider with a confidential client (app) and a public client (spa)
+func oidcTestRouter(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OIDC_ISSUER", "https://idp.example.com/")
+	t.Setenv("OIDC_CLIENTS", "app:{PLAIN}s3cret=https://app.example.com/cb,spa=https://spa.example.com/cb")
+	t.Setenv("JWT_USER_STORE", "env")
+	t.Setenv("JWT_USERS", "alice:{PLAIN}pa55")
+	router := gin.New()
+	router.SetHTMLTemplate(template.Must(template.New("").ParseFS(embeddedFS, "templates/*.tmpl")))
+	router.GET("/.well-known/openid-configuration", oidcDiscoveryHandler)
+	router.POST("/v1/oidc/authorize", oidcLoginHandler)
+	router.POST("/v1/oidc/token", oidcTokenHandler)
+	return router
+}
+
+// oidcTestLogin signs in alice and returns the code of the redirection
+func oidcTestLogin(t *testing.T, router *gin.Engine, params url.Values) string {
+	form := url.Values{"response_type": {"code"}, "scope": {"openid profile"}, "state": {"xyz"}, "username": {"alice"}, "password": {"pa55"}}
+	for key, values := range params {
+		form[key] = values
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/oidc/authorize", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login : status %d, %d expected", w.Code, http.StatusFound)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("state") != "xyz" {
+		t.Fatalf("redirection %s without the state", location)
+	}
+	return location.Query().Get("code")
+}
+
+// oidcTestToken posts the form to the token endpoint and returns the status and the JSON response
+func oidcTestToken(router *gin.Engine, form url.Values, basic ...string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/oidc/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(basic) == 2 {
+		r.SetBasicAuth(basic[0], basic[1])
+	}
+	router.ServeHTTP(w, r)
+	response := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	router := oidcTestRouter(t)
+	redirectURI := "https://app.example.com/cb"
+	code := oidcTestLogin(t, router, url.Values{"client_id": {"app"}, "redirect_uri": {redirectURI}, "nonce": {"n-1"}})
+
+	status, response := oidcTestToken(router, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}}, "app", "s3cret")
+	if status != http.StatusOK {
+		t.Fatalf("token : status %d %v", status, response)
+	}
+	idToken, _ := response["id_token"].(string)
+	refreshToken, _ := response["refresh_token"].(string)
+	claims := &oidcIDToken{}
+	if _, _, err := jwt.NewParser().ParseUnverified(idToken, claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "https://idp.example.com" || claims.Subject != "alice" || !claims.VerifyAudience("app", true) || claims.Nonce != "n-1" {
+		t.Fatalf("id_token claims %+v", claims)
+	}
+
+	// the code is used once
+	status, response = oidcTestToken(router, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}}, "app", "s3cret")
+	if status != http.StatusBadRequest || response["error"] != "invalid_grant" {
+		t.Fatalf("code reused : status %d %v", status, response)
+	}
+
+	// the refresh token is used once
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+	if status, response = oidcTestToken(router, refresh, "app", "s3cret"); status != http.StatusOK {
+		t.Fatalf("refresh : status %d %v", status, response)
+	}
+	if status, response = oidcTestToken(router, refresh, "app", "s3cret"); status != http.StatusBadRequest || response["error"] != "invalid_grant" {
+		t.Fatalf("refresh token reused : status %d %v", status, response)
+	}
+}
+
+func TestOIDCTokenRedirectURI(t *testing.T) {
+	router := oidcTestRouter(t)
+	redirectURI := "https://app.example.com/cb"
+	tests := []struct {
+		name        string
+		redirectURI string
+		error       string
+	}{
+		{"missing", "", "invalid_request"},
+		{"different", "https://app.example.com/other", "invalid_grant"},
+		{"prefix", redirectURI + "/", "invalid_grant"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code := oidcTestLogin(t, router, url.Values{"client_id": {"app"}, "redirect_uri": {redirectURI}})
+			form := url.Values{"grant_type": {"authorization_code"}, "code": {code}}
+			if len(test.redirectURI) > 0 {
+				form.Set("redirect_uri", test.redirectURI)
+			}
+			status, response := oidcTestToken(router, form, "app", "s3cret")
+			if status != http.StatusBadRequest || response["error"] != test.error {
+				t.Fatalf("status %d %v, %s expected", status, response, test.error)
+			}
+		})
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	router := oidcTestRouter(t)
+	redirectURI := "https://spa.example.com/cb"
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		plain     string // OIDC_PKCE_PLAIN
+		login     string // error of the redirection
+		status    int
+	}{
+		{name: "S256", challenge: challenge, method: "S256", verifier: verifier, status: http.StatusOK},
+		{name: "S256 wrong verifier", challenge: challenge, method: "S256", verifier: verifier + "x", status: http.StatusBadRequest},
+		{name: "S256 without verifier", challenge: challenge, method: "S256", status: http.StatusBadRequest},
+		{name: "S256 verifier as challenge", challenge: challenge, method: "S256", verifier: challenge, status: http.StatusBadRequest},
+		{name: "public client without PKCE", login: "invalid_request"},
+		{name: "plain refused", challenge: verifier, method: "plain", verifier: verifier, login: "invalid_request"},
+		{name: "default method is plain", challenge: verifier, verifier: verifier, login: "invalid_request"},
+		{name: "plain accepted", challenge: verifier, method: "plain", verifier: verifier, plain: "true", status: http.StatusOK},
+		{name: "unknown method", challenge: challenge, method: "S512", verifier: verifier, plain: "true", login: "invalid_request"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("OIDC_PKCE_PLAIN", test.plain)
+			params := url.Values{"client_id": {"spa"}, "redirect_uri": {redirectURI}, "code_challenge": {test.challenge}}
+			if len(test.method) > 0 {
+				params.Set("code_challenge_method", test.method)
+			}
+			code := oidcTestLogin(t, router, params)
+			if len(test.login) > 0 {
+				if len(code) > 0 {
+					t.Fatalf("code delivered, error %s expected", test.login)
+				}
+				return
+			}
+			form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "client_id": {"spa"}}
+			if len(test.verifier) > 0 {
+				form.Set("code_verifier", test.verifier)
+			}
+			if status, response := oidcTestToken(router, form); status != test.status {
+				t.Fatalf("status %d %v, %d expected", status, response, test.status)
+			}
+		})
+	}
+}
+
+func TestOIDCCodeExpiration(t *testing.T) {
+	router := oidcTestRouter(t)
+	redirectURI := "https://app.example.com/cb"
+	code := oidcTestLogin(t, router, url.Values{"client_id": {"app"}, "redirect_uri": {redirectURI}})
+	oidcCodes.mu.Lock()
+	oidcCodes.codes[code].expiration = time.Now().Add(-time.Second)
+	oidcCodes.mu.Unlock()
+
+	status, response := oidcTestToken(router, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}}, "app", "s3cret")
+	if status != http.StatusBadRequest || response["error"] != "invalid_grant" {
+		t.Fatalf("expired code : status %d %v", status, response)
+	}
+
+	// the code of another client is refused
+	code = oidcTestLogin(t, router, url.Values{"client_id": {"spa"}, "redirect_uri": {"https://spa.example.com/cb"}, "code_challenge": {"abc"}, "code_challenge_method": {"S256"}})
+	status, response = oidcTestToken(router, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://spa.example.com/cb"}}, "app", "s3cret")
+	if status != http.StatusBadRequest || response["error"] != "invalid_grant" {
+		t.Fatalf("code of another client : status %d %v", status, response)
+	}
+}
+
+func TestOIDCIssuer(t *testing.T) {
+	router := oidcTestRouter(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil)
+	r.Host = "evil.example.com"
+	r.Header.Set("X-Forwarded-Proto", "http")
+	router.ServeHTTP(w, r)
+	var discovery oidcDiscovery
+	if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if discovery.Issuer != "https://idp.example.com" || discovery.TokenEndpoint != "https://idp.example.com/v1/oidc/token" {
+		t.Fatalf("discovery %+v", discovery)
+	}
+	if strings.Join(discovery.CodeChallengeMethodsSupported, " ") != "S256" {
+		t.Fatalf("code_challenge_methods_supported %v", discovery.CodeChallengeMethodsSupported)
+	}
+
+	t.Setenv("OIDC_ISSUER", "")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("without OIDC_ISSUER : status %d", w.Code)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --------------------------- Redaction of secrets
+
+const redactedValue = "****"
+
+// revealSecrets disables the redaction (--reveal-secrets), only for debugging
+var revealSecrets bool
+
+// sensitiveKeys are the names of the fields, query parameters and variables masked in the logs,
+// completed with MACGOVER_SENSITIVE_KEYS (comma separated)
+var sensitiveKeys = []string{
+	"password", "passwd", "pwd", "secret", "client_secret", "token", "access_token",
+	"refresh_token", "id_token", "api_key", "apikey", "authorization", "private_key",
+}
+
+// sensitiveHeaders are masked in the logs
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+var (
+	redactJWTRegexp      = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	redactAuthRegexp     = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+	redactUserinfoRegexp = regexp.MustCompile(`(://[^/:@\s]+:)[^@\s]+@`)
+	redactKeyValueRegexp *regexp.Regexp
+)
+
+func init() {
+	for _, key := range strings.Split(os.Getenv("MACGOVER_SENSITIVE_KEYS"), ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); len(key) > 0 {
+			sensitiveKeys = append(sensitiveKeys, key)
+		}
+	}
+	quoted := make([]string, 0, len(sensitiveKeys))
+	for _, key := range sensitiveKeys {
+		// - and _ are the same (x-api-key, x_api_key)
+		quoted = append(quoted, strings.ReplaceAll(regexp.QuoteMeta(key), "_", "[_-]"))
+	}
+	// key=value, key: value, "key": "value", key:[value] (the key may have a prefix, ex DB_PASSWORD=)
+	redactKeyValueRegexp = regexp.MustCompile(`(?i)([A-Za-z0-9_.-]*(?:` + strings.Join(quoted, "|") + `)"?\s*[:=]\s*"?\[?)([^"&\s,;}\[\]]+)`)
+
+	// all the logs (log and gin) are redacted
+	log.SetOutput(redactWriter{os.Stderr})
+	gin.DefaultWriter = redactWriter{os.Stdout}
+	gin.DefaultErrorWriter = redactWriter{os.Stderr}
+}
+
+// isSensitiveKey returns true for a sensitive key, or a key with a sensitive suffix, - and _ are the same
+func isSensitiveKey(key string) bool {
+	key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+	for _, k := range sensitiveKeys {
+		if k = strings.ReplaceAll(k, "-", "_"); key == k || strings.HasSuffix(key, "_"+k) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSecret returns the value masked (or the value with --reveal-secrets)
+func maskSecret(value string) string {
+	if revealSecrets || len(value) == 0 {
+		return value
+	}
+	return redactedValue
+}
+
+// redactString masks the JWTs, the Authorization values, the passwords of the URLs
+// and the values of the sensitive keys found in a free text
+func redactString(s string) string {
+	if revealSecrets {
+		return s
+	}
+	s = redactJWTRegexp.ReplaceAllString(s, redactedValue)
+	s = redactAuthRegexp.ReplaceAllString(s, "$1 "+redactedValue)
+	s = redactUserinfoRegexp.ReplaceAllString(s, "${1}"+redactedValue+"@")
+	s = redactKeyValueRegexp.ReplaceAllString(s, "${1}"+redactedValue)
+	return s
+}
+
+// redactQuery returns a copy of the query string with the sensitive parameters masked
+func redactQuery(values url.Values) url.Values {
+	redacted := url.Values{}
+	for key, list := range values {
+		for _, v := range list {
+			if isSensitiveKey(key) {
+				v = maskSecret(v)
+			} else {
+				v = redactString(v)
+			}
+			redacted.Add(key, v)
+		}
+	}
+	return redacted
+}
+
+// redactHeaders returns a copy of the headers with the credentials masked (sensitiveHeaders and the
+// headers named like a sensitive key, ex X-Auth-Token)
+func redactHeaders(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for name, values := range redacted {
+		if !isSensitiveHeader(name) {
+			continue
+		}
+		for i := range values {
+			values[i] = maskSecret(values[i])
+		}
+	}
+	return redacted
+}
+
+func isSensitiveHeader(name string) bool {
+	for _, h := range sensitiveHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return isSensitiveKey(name)
+}
+
+// redactJSON masks the sensitive keys of a decoded JSON document
+func redactJSON(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			if s, ok := item.(string); ok && isSensitiveKey(key) {
+				value[key] = maskSecret(s)
+				continue
+			}
+			value[key] = redactJSON(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactJSON(item)
+		}
+	case string:
+		return redactString(value)
+	}
+	return v
+}
+
+// redactBody masks the secrets of a body (JSON, form or text)
+func redactBody(body []byte, contentType string) string {
+	if revealSecrets {
+		return string(body)
+	}
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err == nil {
+		if redacted, err := json.Marshal(redactJSON(document)); err == nil {
+			return string(redacted)
+		}
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			return redactQuery(values).Encode()
+		}
+	}
+	return redactString(string(body))
+}
+
+// redactWriter masks the secrets of every line written in the logs
+type redactWriter struct {
+	out io.Writer
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if revealSecrets {
+		return w.out.Write(p)
+	}
+	if _, err := w.out.Write([]byte(redactString(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// --------------------------- TLS informations
+
+type tlsCertificateInfo struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	DNSNames     []string  `json:"dns_names,omitempty"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	ExpiresIn    string    `json:"expires_in"`
+	Expired      bool      `json:"expired"`
+}
+
+// tlsInfo is the report of a TLS handshake
+type tlsInfo struct {
+	Version      string               `json:"version,omitempty"`
+	CipherSuite  string               `json:"cipher_suite,omitempty"`
+	ServerName   string               `json:"server_name,omitempty"`
+	Certificates []tlsCertificateInfo `json:"certificates,omitempty"`
+	Error        string               `json:"error,omitempty"`
+}
+
+func newTLSInfo(state tls.ConnectionState) *tlsInfo {
+	info := &tlsInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	for _, cert := range state.PeerCertificates {
+		info.Certificates = append(info.Certificates, newTLSCertificateInfo(cert))
+	}
+	return info
+}
+
+func newTLSCertificateInfo(cert *x509.Certificate) tlsCertificateInfo {
+	return tlsCertificateInfo{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		DNSNames:     cert.DNSNames,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		ExpiresIn:    time.Until(cert.NotAfter).Round(time.Second).String(),
+		Expired:      time.Now().After(cert.NotAfter),
+	}
+}
+
+// String displays the report in text format
+func (i *tlsInfo) String() string {
+	if len(i.Error) > 0 {
+		return "TLS: " + i.Error
+	}
+	lines := []string{"TLS: " + i.Version + " " + i.CipherSuite}
+	for n, cert := range i.Certificates {
+		lines = append(lines, fmt.Sprintf("Certificate[%d]: subject=%s issuer=%s not_after=%s expires_in=%s", n, cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339), cert.ExpiresIn))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.New("no certificate found in " + file)
+	}
+	return pool, nil
+}
+
+// verifyChainOnly verifies the certificate chain against roots without checking the hostname
+func verifyChainOnly(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}